@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+)
+
+type askCmdParams struct {
+	ragParams
+	json        bool
+	batch       string
+	out         string
+	concurrency int
+}
+
+func newAskCmd(params *askCmdParams) *flag.FlagSet {
+	cmd := flag.NewFlagSet("ask", flag.ExitOnError)
+	addRAGFlags(cmd, &params.ragParams)
+	cmd.BoolVar(&params.json, "json", false, "print the answer, citations, grounding scores & token usage as JSON")
+	cmd.StringVar(&params.batch, "batch", "", `JSON Lines file of questions like {"id": 1, "question": "..."} to answer; "-" reads standard input`)
+	cmd.StringVar(&params.out, "out", "-", "JSON Lines file the -batch answers are written to in question order; \"-\" writes standard output")
+	cmd.IntVar(&params.concurrency, "concurrency", 4, "maximum number of -batch questions answered at once")
+	return cmd
+}
+
+// askResult is an answer as printed by -json & -batch.
+type askResult struct {
+	ID               any                `json:"id,omitempty"` // The -batch question's id
+	Question         string             `json:"question"`
+	SearchQuery      string             `json:"searchQuery,omitempty"`
+	Answer           string             `json:"answer"`
+	NotCovered       bool               `json:"notCovered,omitempty"`
+	Truncated        bool               `json:"truncated,omitempty"`
+	Citations        []askCitation      `json:"citations"`
+	InvalidCitations []int              `json:"invalidCitations,omitempty"`
+	Groundings       []sessionGrounding `json:"groundings"` // Numbered from 1 in the order given to the model
+	Verification     *verification      `json:"verification,omitempty"`
+	Usage            *tokenUsage        `json:"usage,omitempty"` // Estimated tokens used by the answer's completion request
+	Error            string             `json:"error,omitempty"`
+}
+
+type askCitation struct {
+	Number    int     `json:"number"`
+	Score     float32 `json:"score"`
+	Source    string  `json:"source,omitempty"`
+	FirstPage int     `json:"firstPage,omitempty"`
+	LastPage  int     `json:"lastPage,omitempty"`
+}
+
+func newAskResult(question string, ans *ragAnswer, err error) askResult {
+	result := askResult{Question: question, Citations: []askCitation{}, Groundings: []sessionGrounding{}}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if ans == nil {
+		return result
+	}
+	result.SearchQuery, result.Answer, result.NotCovered, result.Truncated = ans.SearchQuery, ans.Answer, ans.NotCovered, ans.Truncated
+	for _, n := range ans.Cited {
+		g := ans.Groundings[n-1]
+		result.Citations = append(result.Citations, askCitation{Number: n, Score: g.Score, Source: g.Source, FirstPage: g.FirstPage, LastPage: g.LastPage})
+	}
+	result.InvalidCitations = ans.InvalidCitations
+	result.Groundings = newSessionGroundings(ans.Groundings)
+	result.Verification = ans.Verification
+	if !ans.NotCovered {
+		result.Usage = &ans.Usage
+	}
+	return result
+}
+
+func ask(arguments []string) error {
+	params := &askCmdParams{}
+	cmd := newAskCmd(params)
+	if err := parseCmdLine(cmd, arguments); err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt) // Ctrl-C cancels the outstanding questions
+	defer stop()
+
+	if params.batch != "" {
+		if cmd.NArg() != 0 {
+			return usageError("ask -batch <questions.jsonl> [-out <answers.jsonl>]; a question argument can't be used with -batch")
+		}
+		failed, err := askBatch(ctx, params)
+		if err == nil && failed > 0 {
+			err = fmt.Errorf("%d questions couldn't be answered", failed)
+		}
+		return err
+	}
+
+	question := strings.Join(cmd.Args(), " ")
+	if question == "" { // Read the question from standard input, for example: echo "..." | VectorDB ask
+		stdin, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("reading the question: %w", err)
+		}
+		question = string(stdin)
+	}
+	if question = strings.TrimSpace(question); question == "" {
+		return usageError("ask [flags] <question>; without a question argument, the question is read from standard input")
+	}
+
+	rp, err := newRAGPipeline(&params.ragParams)
+	if err != nil {
+		return err
+	}
+	cm, err := rp.NewConversation()
+	if err != nil {
+		return err
+	}
+	req := ragRequest{Question: question, Conversation: cm}
+	if !params.json {
+		req.Content = func(content string) { fmt.Print(content) }
+	}
+	ans, err := rp.Answer(ctx, req)
+	if params.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(newAskResult(question, ans, err)); encErr != nil {
+			return errors.Join(err, encErr)
+		}
+	} else if ans != nil && ans.Answer != "" {
+		printReferences(os.Stdout, ans.Groundings, ans.Answer)
+		printVerification(os.Stdout, ans.Verification)
+		fmt.Println()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+	return err
+}
+
+// askBatch answers the questions in the -batch file & returns the number that failed. It returns
+// an error if the questions can't be read or the answers can't be written.
+func askBatch(ctx context.Context, params *askCmdParams) (failed int, err error) {
+	in := os.Stdin
+	if params.batch != "-" {
+		if in, err = os.Open(params.batch); err != nil {
+			return 0, err
+		}
+		defer in.Close()
+	}
+	type batchQuestion struct {
+		ID       any    `json:"id"`
+		Question string `json:"question"`
+	}
+	questions := []batchQuestion{}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1<<20) // Allow long questions
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		q := batchQuestion{}
+		if err := json.Unmarshal(scanner.Bytes(), &q); err != nil || strings.TrimSpace(q.Question) == "" {
+			return 0, usageError("%s:%d: expected a JSON object with a \"question\"", params.batch, line)
+		}
+		questions = append(questions, q)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("reading %s: %w", params.batch, err)
+	}
+
+	out := os.Stdout
+	if params.out != "-" {
+		if out, err = os.Create(params.out); err != nil {
+			return 0, err
+		}
+		defer func() {
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+	}
+	if params.concurrency < 1 {
+		params.concurrency = 1
+	}
+
+	// Answer concurrently but write the answers in question order as each becomes available
+	rp, err := newRAGPipeline(&params.ragParams)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithCancel(ctx) // Stops answering if the answers can't be written
+	defer cancel()
+	results, done := make([]askResult, len(questions)), make([]chan struct{}, len(questions))
+	sem, wg := make(chan struct{}, params.concurrency), sync.WaitGroup{}
+	for i := range questions {
+		done[i] = make(chan struct{})
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer close(done[i])
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			q := questions[i]
+			cm, err := rp.NewConversation()
+			var ans *ragAnswer
+			if err == nil {
+				ans, err = rp.Answer(ctx, ragRequest{Question: q.Question, Conversation: cm, SessionID: "batch"})
+			}
+			results[i] = newAskResult(q.Question, ans, err)
+			results[i].ID = q.ID
+		}(i)
+	}
+	enc := json.NewEncoder(out)
+	for i := range questions {
+		<-done[i]
+		if err := enc.Encode(results[i]); err != nil {
+			cancel()
+			wg.Wait()
+			return failed, fmt.Errorf("writing the answers: %w", err)
+		}
+		if results[i].Error != "" {
+			failed++
+		}
+	}
+	wg.Wait()
+	fmt.Fprintf(os.Stderr, "Answered %d of %d questions\n", len(questions)-failed, len(questions))
+	if errors.Is(ctx.Err(), context.Canceled) {
+		fmt.Fprintln(os.Stderr, "Cancelled")
+	}
+	return failed, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/cognitiveservices/azopenai"
+)
+
+type authParams struct {
+	method   string // "key", "default", "managedidentity", "workloadidentity", "azurecli" or "environment"
+	apiKey   string
+	clientID string // Client ID of a user-assigned managed identity
+}
+
+// addAuthFlags adds the flags that select how to authenticate against the AI services to cmd.
+func addAuthFlags(cmd *flag.FlagSet, p *authParams) {
+	cmd.StringVar(&p.method, "auth", "key", "authentication: key (uses -apikey) or, for Azure OpenAI, an Entra ID token from default, managedidentity, workloadidentity, azurecli or environment (client secret)")
+	cmd.StringVar(&p.apiKey, "apikey", "", "API key used to authenticate against the OpenAI service when -auth=key")
+	cmd.StringVar(&p.clientID, "clientid", "", "client ID of a user-assigned managed identity when -auth=managedidentity")
+}
+
+// serviceCredential authenticates requests to the AI services with either an API key or an
+// Entra ID token credential. A single token credential is shared by all clients so they share its
+// token cache; azcore's bearer token policy refreshes tokens before they expire so long-running
+// ingests never see an expired token.
+type serviceCredential struct {
+	apiKey string
+	token  azcore.TokenCredential // nil when authenticating with apiKey
+}
+
+// newServiceCredential returns the credential selected by p. It returns an error wrapping errUsage
+// if p.method is unknown & one wrapping ErrAuth if the token credential can't be created.
+func newServiceCredential(p authParams) (serviceCredential, error) {
+	var token azcore.TokenCredential
+	var err error
+	switch p.method {
+	case "key":
+		return serviceCredential{apiKey: p.apiKey}, nil
+	case "default": // Tries environment, workload identity, managed identity & Azure CLI in turn
+		token, err = azidentity.NewDefaultAzureCredential(nil)
+	case "managedidentity":
+		o := &azidentity.ManagedIdentityCredentialOptions{}
+		if p.clientID != "" {
+			o.ID = azidentity.ClientID(p.clientID)
+		}
+		token, err = azidentity.NewManagedIdentityCredential(o)
+	case "workloadidentity":
+		token, err = azidentity.NewWorkloadIdentityCredential(nil)
+	case "azurecli":
+		token, err = azidentity.NewAzureCLICredential(nil)
+	case "environment": // AZURE_TENANT_ID, AZURE_CLIENT_ID & AZURE_CLIENT_SECRET (or a certificate)
+		token, err = azidentity.NewEnvironmentCredential(nil)
+	default:
+		return serviceCredential{}, usageError("unknown authentication method %q; expected key, default, managedidentity, workloadidentity, azurecli or environment", p.method)
+	}
+	if err != nil {
+		return serviceCredential{}, fmt.Errorf("%w: -auth=%s: %w", ErrAuth, p.method, err)
+	}
+	return serviceCredential{token: token}, nil
+}
+
+// newAzureClient creates a client for an Azure OpenAI deployment; it returns an error wrapping
+// errUsage if url is invalid.
+func newAzureClient(url string, cred serviceCredential, deployment string) (*azopenai.Client, error) {
+	var client *azopenai.Client
+	var err error
+	if cred.token != nil {
+		client, err = azopenai.NewClient(url, cred.token, deployment, nil)
+	} else {
+		kc, _ := azopenai.NewKeyCredential(cred.apiKey)
+		client, err = azopenai.NewClientWithKeyCredential(url, kc, deployment, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUsage, err)
+	}
+	return client, nil
+}
+
+// newOpenAIClient creates a client for the public OpenAI API or an OpenAI-compatible server.
+// These services don't accept Entra ID tokens so cred must hold an API key (which local
+// servers typically ignore). It returns an error wrapping errUsage if cred or url is invalid.
+func newOpenAIClient(url string, cred serviceCredential) (*azopenai.Client, error) {
+	if cred.token != nil {
+		return nil, usageError("Entra ID authentication is only supported by Azure OpenAI; use -auth=key")
+	}
+	kc, _ := azopenai.NewKeyCredential(cred.apiKey)
+	client, err := azopenai.NewClientForOpenAI(url, kc, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUsage, err)
+	}
+	return client, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// embeddingCache is a content-addressed, on-disk cache of embedding vectors keyed by the
+// model deployment & a hash of the embedded text. Each vector is stored in its own file and a
+// file's modification time records when the vector was last used so eviction is LRU.
+type embeddingCache struct {
+	dir      string
+	maxBytes int64      // 0 means unlimited
+	mu       sync.Mutex // Serializes Put & Prune so concurrent questions can share the cache
+	size     int64      // -1 until the directory has been measured
+}
+
+// newEmbeddingCache returns a cache rooted at dir; it returns nil (caching disabled) if dir is "".
+func newEmbeddingCache(dir string, maxBytes int64) *embeddingCache {
+	if dir == "" {
+		return nil
+	}
+	return &embeddingCache{dir: dir, maxBytes: maxBytes, size: -1}
+}
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "VectorDB", "embeddings")
+}
+
+func (c *embeddingCache) pathname(model, text string) string {
+	h := sha256.New()
+	h.Write([]byte(model))
+	h.Write([]byte{0}) // Separates model from text so ("ab", "c") & ("a", "bc") hash differently
+	h.Write([]byte(text))
+	key := hex.EncodeToString(h.Sum(nil))
+	return filepath.Join(c.dir, key[:2], key) // Fan out across subdirectories to keep directories small
+}
+
+// Get returns the cached vector for model & text; ok is false on a cache miss.
+func (c *embeddingCache) Get(model, text string) (vector []float32, ok bool) {
+	if c == nil {
+		return nil, false
+	}
+	pathname := c.pathname(model, text)
+	data, err := os.ReadFile(pathname)
+	if err != nil {
+		return nil, false // Missing or unreadable; either way, the caller re-embeds
+	}
+	vector = make([]float32, len(data)/4)
+	if binary.Read(bytes.NewReader(data), binary.LittleEndian, vector) != nil {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(pathname, now, now) // Mark as recently used; failure only affects eviction order
+	return vector, true
+}
+
+// Put adds the vector for model & text to the cache, evicting least-recently used vectors if
+// the cache grows beyond its size limit.
+func (c *embeddingCache) Put(model, text string, vector []float32) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pathname := c.pathname(model, text)
+	if err := os.MkdirAll(filepath.Dir(pathname), 0o755); err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.LittleEndian, vector); err != nil {
+		return err
+	}
+	tmpPathname := pathname + ".tmp"
+	if err := os.WriteFile(tmpPathname, buf.Bytes(), 0o644); err != nil {
+		os.Remove(tmpPathname) // Don't leave a partial file behind; it would never be evicted
+		return err
+	}
+	if err := os.Rename(tmpPathname, pathname); err != nil {
+		return err
+	}
+
+	if c.maxBytes <= 0 {
+		return nil
+	}
+	if c.size < 0 {
+		stats, err := c.Stats()
+		if err != nil {
+			return err
+		}
+		c.size = stats.Bytes
+	} else {
+		c.size += int64(buf.Len())
+	}
+	if c.size > c.maxBytes {
+		_, _, err := c.prune(c.maxBytes * 9 / 10) // Prune below the limit so that we don't prune on every Put
+		return err
+	}
+	return nil
+}
+
+type cacheFile struct {
+	pathname string
+	size     int64
+	lastUsed time.Time
+}
+
+func (c *embeddingCache) files() ([]cacheFile, error) {
+	files := []cacheFile{}
+	err := filepath.WalkDir(c.dir, func(pathname string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, cacheFile{pathname: pathname, size: info.Size(), lastUsed: info.ModTime()})
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return files, nil
+}
+
+type cacheStats struct {
+	Entries        int
+	Bytes          int64
+	Oldest, Newest time.Time
+}
+
+func (c *embeddingCache) Stats() (cacheStats, error) {
+	files, err := c.files()
+	if err != nil {
+		return cacheStats{}, err
+	}
+	stats := cacheStats{}
+	for _, f := range files {
+		stats.Entries++
+		stats.Bytes += f.size
+		if stats.Oldest.IsZero() || f.lastUsed.Before(stats.Oldest) {
+			stats.Oldest = f.lastUsed
+		}
+		if f.lastUsed.After(stats.Newest) {
+			stats.Newest = f.lastUsed
+		}
+	}
+	return stats, nil
+}
+
+// Prune evicts the least-recently used vectors until the cache holds at most maxBytes.
+func (c *embeddingCache) Prune(maxBytes int64) (removed int, freed int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.prune(maxBytes)
+}
+
+func (c *embeddingCache) prune(maxBytes int64) (removed int, freed int64, err error) {
+	files, err := c.files()
+	if err != nil {
+		return 0, 0, err
+	}
+	slices.SortFunc(files, func(a, b cacheFile) bool { return a.lastUsed.Before(b.lastUsed) }) // Least-recently used first
+	size := int64(0)
+	for _, f := range files {
+		size += f.size
+	}
+	for _, f := range files {
+		if size <= maxBytes {
+			break
+		}
+		if err := os.Remove(f.pathname); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			c.size = -1 // Unknown; recomputed by the next Put
+			return removed, freed, err
+		}
+		size -= f.size
+		removed, freed = removed+1, freed+f.size
+	}
+	c.size = size
+	return removed, freed, nil
+}
+
+// cachingEmbedder is an Embedder that consults the cache before calling the Embedder it wraps.
+type cachingEmbedder struct {
+	Embedder
+	cache *embeddingCache
+}
+
+// newCachingEmbedder wraps e with cache c; if caching is disabled (c is nil), e is returned as is.
+func newCachingEmbedder(e Embedder, c *embeddingCache) Embedder {
+	if c == nil {
+		return e
+	}
+	return &cachingEmbedder{Embedder: e, cache: c}
+}
+
+func (e *cachingEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	missing := []int{} // Indices of texts not in the cache
+	for i, text := range texts {
+		if vector, ok := e.cache.Get(e.Model(), text); ok && (e.Dimensions() == 0 || len(vector) == e.Dimensions()) {
+			vectors[i] = vector
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return vectors, nil
+	}
+
+	// Embed all the cache misses in a single call
+	missingTexts := make([]string, len(missing))
+	for i, n := range missing {
+		missingTexts[i] = texts[n]
+	}
+	embedded, err := e.Embedder.Embed(ctx, missingTexts)
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range missing {
+		vectors[n] = embedded[i]
+		if err := e.cache.Put(e.Model(), texts[n], embedded[i]); err != nil {
+			log.Printf("Warning: caching an embedding: %v", err) // The vector is still good; it'll just be embedded again next time
+		}
+	}
+	return vectors, nil
+}
+
+// addCacheFlags adds the flags that configure the embedding cache to cmd.
+func addCacheFlags(cmd *flag.FlagSet, dir *string, maxMB *int64) {
+	cmd.StringVar(dir, "cache", defaultCacheDir(), "directory of the embedding cache; empty disables caching")
+	cmd.Int64Var(maxMB, "cachemaxmb", 1024, "maximum size of the embedding cache in megabytes; 0 is unlimited")
+}
+
+type cacheCmdParams struct {
+	dir   string
+	maxMB int64
+}
+
+func newCacheCmd(name string, params *cacheCmdParams) *flag.FlagSet {
+	cmd := flag.NewFlagSet("cache "+name, flag.ExitOnError)
+	addCacheFlags(cmd, &params.dir, &params.maxMB)
+	return cmd
+}
+
+func cache(arguments []string) error {
+	if len(arguments) < 1 {
+		return usageError("expected 'stats' or 'prune' cache subcommands")
+	}
+	params := cacheCmdParams{}
+	if err := parseCmdLine(newCacheCmd(arguments[0], &params), arguments[1:]); err != nil {
+		return err
+	}
+	c := newEmbeddingCache(params.dir, params.maxMB<<20)
+	if c == nil {
+		return usageError("no cache directory specified")
+	}
+
+	switch arguments[0] { // Check which cache subcommand is invoked.
+	case "stats":
+		stats, err := c.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Directory: %s\n", c.dir)
+		fmt.Printf("Entries:   %d\n", stats.Entries)
+		fmt.Printf("Size:      %.1f MB of %d MB\n", float64(stats.Bytes)/(1<<20), params.maxMB)
+		if stats.Entries > 0 {
+			fmt.Printf("Last used: %s (oldest) to %s (newest)\n", stats.Oldest.Format(time.RFC3339), stats.Newest.Format(time.RFC3339))
+		}
+	case "prune":
+		if c.maxBytes <= 0 {
+			fmt.Println("Cache size is unlimited; nothing to prune")
+			return nil
+		}
+		removed, freed, err := c.Prune(c.maxBytes)
+		fmt.Printf("Removed %d entries, freeing %.1f MB\n", removed, float64(freed)/(1<<20))
+		return err
+	default:
+		return usageError("expected 'stats' or 'prune' cache subcommands")
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/cognitiveservices/azopenai"
+
+	"JeffreyRichter.com/VectorDB/rag"
+)
+
+// ChatModel is a chat completion model that streams its answers.
+type ChatModel interface {
+	// StreamChat sends msgs to the model & returns a stream of the answer. Errors returned by
+	// StreamChat & by the stream are normalized; see ErrContextLengthExceeded, etc.
+	StreamChat(ctx context.Context, msgs []azopenai.ChatMessage, o chatOptions) (ChatStream, error)
+
+	// Model identifies the model answering.
+	Model() string
+}
+
+// ChatStream is the streamed answer from a ChatModel.
+type ChatStream interface {
+	// Read returns the next piece of the answer; it returns io.EOF after the last piece. If the
+	// answer was cut short by chatOptions.MaxTokens, the io.EOF also wraps errMaxTokens.
+	Read() (string, error)
+
+	// Close releases the stream's connection; it must be called if Read didn't return an error.
+	Close()
+}
+
+type chatOptions struct {
+	MaxTokens   int32
+	Temperature float32
+}
+
+// Errors returned by ChatModel, Embedder & Reranker implementations regardless of which service
+// produced them. The service's original error is wrapped too so errors.As still finds it.
+var (
+	ErrContextLengthExceeded = rag.ErrContextLengthExceeded
+	ErrContentFiltered       = errors.New("the content was filtered by the service")
+	ErrRateLimited           = errors.New("the service is rate limiting requests")
+	ErrAuth                  = errors.New("the service rejected the credentials")
+	ErrServiceUnavailable    = errors.New("the service can't be reached")
+)
+
+// errMaxTokens is wrapped by ChatStream.Read's io.EOF when the answer reached chatOptions.MaxTokens.
+var errMaxTokens = errors.New("the answer reached the maximum number of tokens")
+
+var _, _ ChatModel = (*azureChatModel)(nil), (*openAIChatModel)(nil)
+
+type chatModelParams struct {
+	provider string        // "azure", "openai" or "openaicompat"
+	url      string        // Defaults to the command's -url if empty
+	model    string        // Azure deployment name or OpenAI model name
+	timeout  time.Duration // Limits each request including reading the whole stream; 0 means no limit
+}
+
+// addChatModelFlags adds the flags that select & configure the ChatModel to cmd.
+func addChatModelFlags(cmd *flag.FlagSet, p *chatModelParams) {
+	cmd.StringVar(&p.provider, "chatprovider", "azure", "chat model provider: azure, openai or openaicompat (e.g. Ollama or llama.cpp)")
+	cmd.StringVar(&p.url, "chaturl", "", "URL of the chat service; defaults to -url")
+	cmd.StringVar(&p.model, "chatmodel", "gpt-4", "chat model (the deployment name for Azure OpenAI)")
+	cmd.DurationVar(&p.timeout, "chattimeout", 3*time.Minute, "maximum time for each chat request including streaming the answer; 0 means no limit")
+}
+
+// newChatModel creates the ChatModel selected by p; url is used if p doesn't specify its own URL.
+// It returns an error wrapping errUsage if p is invalid.
+func newChatModel(p chatModelParams, url string, cred serviceCredential) (ChatModel, error) {
+	if p.url != "" {
+		url = p.url
+	}
+	switch p.provider {
+	case "azure":
+		client, err := newAzureClient(url, cred, p.model)
+		if err != nil {
+			return nil, err
+		}
+		return &azureChatModel{client: client, deployment: p.model, timeout: p.timeout}, nil
+	case "openai", "openaicompat":
+		if url == "" && p.provider == "openai" {
+			url = "https://api.openai.com/v1"
+		}
+		client, err := newOpenAIClient(url, cred)
+		if err != nil {
+			return nil, err
+		}
+		return &openAIChatModel{client: client, model: p.model, timeout: p.timeout}, nil
+	default:
+		return nil, usageError("unknown chat model provider %q; expected azure, openai or openaicompat", p.provider)
+	}
+}
+
+// azureChatModel answers using an Azure OpenAI chat deployment.
+type azureChatModel struct {
+	client     *azopenai.Client
+	deployment string
+	timeout    time.Duration
+}
+
+func (m *azureChatModel) StreamChat(ctx context.Context, msgs []azopenai.ChatMessage, o chatOptions) (ChatStream, error) {
+	return streamChat(ctx, m.client, m.timeout, azopenai.ChatCompletionsOptions{
+		Messages:    msgs,
+		MaxTokens:   to.Ptr(o.MaxTokens),
+		Temperature: to.Ptr(o.Temperature),
+	})
+}
+
+func (m *azureChatModel) Model() string { return m.deployment }
+
+// openAIChatModel answers using the public OpenAI API or any server implementing its
+// /chat/completions endpoint (Ollama, llama.cpp, vLLM, etc.).
+type openAIChatModel struct {
+	client  *azopenai.Client
+	model   string
+	timeout time.Duration
+}
+
+func (m *openAIChatModel) StreamChat(ctx context.Context, msgs []azopenai.ChatMessage, o chatOptions) (ChatStream, error) {
+	return streamChat(ctx, m.client, m.timeout, azopenai.ChatCompletionsOptions{
+		Messages:    msgs,
+		Model:       to.Ptr(m.model),
+		MaxTokens:   to.Ptr(o.MaxTokens),
+		Temperature: to.Ptr(o.Temperature),
+	})
+}
+
+func (m *openAIChatModel) Model() string { return m.model }
+
+func streamChat(ctx context.Context, client *azopenai.Client, timeout time.Duration, body azopenai.ChatCompletionsOptions) (ChatStream, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	resp, err := client.GetChatCompletionsStream(ctx, body, nil)
+	if err != nil {
+		err = normalizeServiceError(contextError(ctx, err)) // Before cancel so a canceled ctx means the caller canceled it
+		cancel()
+		return nil, err
+	}
+	return &chatCompletionsStream{reader: resp.ChatCompletionsStream, ctx: ctx, cancel: cancel}, nil
+}
+
+type chatCompletionsStream struct {
+	reader    *azopenai.EventReader[azopenai.ChatCompletions]
+	ctx       context.Context // Canceling ctx interrupts Read
+	cancel    context.CancelFunc
+	maxTokens bool // The service finished the answer because it reached the max tokens
+}
+
+func (s *chatCompletionsStream) Read() (string, error) {
+	for {
+		entry, err := s.reader.Read()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				err = normalizeServiceError(contextError(s.ctx, err))
+			}
+			return "", s.eof(err)
+		}
+		if entry.ID == nil && entry.Choices == nil && entry.PromptAnnotations == nil {
+			return "", s.eof(io.EOF) // The connection ended without a [DONE] event
+		}
+		if len(entry.Choices) == 0 {
+			continue // Azure sends the prompt's content filter results in an entry without choices
+		}
+		choice := entry.Choices[0]
+		if choice.FinishReason != nil {
+			switch *choice.FinishReason {
+			case azopenai.CompletionsFinishReasonContentFilter:
+				return "", ErrContentFiltered
+			case azopenai.CompletionsFinishReasonLength:
+				s.maxTokens = true
+			}
+		}
+		if choice.Delta != nil && choice.Delta.Content != nil {
+			return *choice.Delta.Content, nil
+		}
+		// Role-only & finish entries have no content; read the next entry
+	}
+}
+
+// eof returns err, wrapping errMaxTokens too if err is io.EOF & the answer reached the max tokens.
+func (s *chatCompletionsStream) eof(err error) error {
+	if s.maxTokens && err == io.EOF {
+		return fmt.Errorf("%w: %w", io.EOF, errMaxTokens)
+	}
+	return err
+}
+
+func (s *chatCompletionsStream) Close() {
+	s.reader.Close()
+	s.cancel()
+}
+
+// withTimeout returns ctx limited to timeout; a timeout of 0 means no limit.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// contextError returns err wrapped with the reason ctx ended, if it has, so errors.Is reports
+// context.Canceled or context.DeadlineExceeded however the transport reported the interruption.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %w", ctxErr, err)
+	}
+	return err
+}
+
+// complete returns the model's entire answer to msgs; use it when the answer isn't shown as it streams.
+func complete(ctx context.Context, model ChatModel, msgs []azopenai.ChatMessage, o chatOptions) (string, error) {
+	stream, err := model.StreamChat(ctx, msgs, o)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+	sb := &strings.Builder{}
+	for {
+		content, err := stream.Read()
+		if errors.Is(err, io.EOF) {
+			return sb.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(content)
+	}
+}
+
+// jsonArray returns the JSON array in a model's response: from its first '[' to its last ']'.
+// Models asked to respond with only JSON sometimes wrap it in prose or a code fence anyway.
+// If response has no brackets, it is returned unchanged for the caller's json.Unmarshal to reject.
+func jsonArray(response string) string {
+	if start, end := strings.Index(response, "["), strings.LastIndex(response, "]"); start >= 0 && end > start {
+		return response[start : end+1]
+	}
+	return response
+}
+
+// normalizeServiceError wraps err with ErrContextLengthExceeded, ErrContentFiltered, ErrRateLimited,
+// ErrAuth or ErrServiceUnavailable if err indicates one of those conditions. Azure OpenAI, OpenAI &
+// most OpenAI-compatible servers report these slightly differently so this checks all the
+// variations we know of.
+func normalizeServiceError(err error) error {
+	var cfe *azopenai.ContentFilterResponseError
+	var afe *azidentity.AuthenticationFailedError
+	var ne net.Error
+	switch {
+	case errors.As(err, &cfe):
+		return fmt.Errorf("%w: %w", ErrContentFiltered, err)
+	case errors.As(err, &afe):
+		return fmt.Errorf("%w: %w", ErrAuth, err)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return err
+	case errors.As(err, &ne):
+		return fmt.Errorf("%w: %w", ErrServiceUnavailable, err)
+	}
+	var re *azcore.ResponseError
+	if !errors.As(err, &re) {
+		return err
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case re.StatusCode == http.StatusUnauthorized, re.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: %w", ErrAuth, err)
+	case re.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %w", ErrRateLimited, err)
+	case re.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("%w: %w", ErrServiceUnavailable, err)
+	case re.ErrorCode == "context_length_exceeded",
+		re.StatusCode == http.StatusBadRequest && (strings.Contains(msg, "maximum context length") || strings.Contains(msg, "context window")):
+		return fmt.Errorf("%w: %w", ErrContextLengthExceeded, err)
+	case re.ErrorCode == "content_filter":
+		return fmt.Errorf("%w: %w", ErrContentFiltered, err)
+	}
+	return err
+}
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestJSONArray(t *testing.T) {
+	for _, tc := range []struct{ response, want string }{
+		{"[1, 2]", "[1, 2]"},
+		{"Here is the ordering: [3, 1, 2].", "[3, 1, 2]"},
+		{"```json\n[true, false]\n```", "[true, false]"},
+		{"no JSON here", "no JSON here"},
+		{"] backwards [", "] backwards ["},
+	} {
+		if got := jsonArray(tc.response); got != tc.want {
+			t.Errorf("jsonArray(%q) = %q; want %q", tc.response, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+// checkpoint captures the progress of a createdb run so that an interrupted run can resume
+// without re-embedding the chunks it already sent to the embedding service.
+type checkpoint struct {
+	SourceHash string           // SHA-256 of the source file; a checkpoint for a different source is never resumed
+	Chunks     []string         // All the chunks produced by the text splitter, in document order
+	Entries    []vectordb.Entry // Embedded entries for Chunks[:len(Entries)], in document order
+}
+
+func checkpointPathname(dbPathname string) string { return dbPathname + ".checkpoint" }
+
+// saveCheckpoint writes the checkpoint to a temporary file & then renames it so that a crash
+// while writing never leaves a partially-written checkpoint behind.
+func saveCheckpoint(pathname string, cp *checkpoint) error {
+	tmpPathname := pathname + ".tmp"
+	f, err := os.Create(tmpPathname)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(cp); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPathname, pathname)
+}
+
+// restoreCheckpoint returns the checkpoint saved at pathname; ok is false if there is no checkpoint.
+func restoreCheckpoint(pathname string) (cp *checkpoint, ok bool, err error) {
+	f, err := os.Open(pathname)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	cp = &checkpoint{}
+	if err := gob.NewDecoder(f).Decode(cp); err != nil {
+		return nil, false, fmt.Errorf("%w: %w", vectordb.ErrDBCorrupt, err)
+	}
+	return cp, true, nil
+}
+
+// hashFile returns the hex-encoded SHA-256 of the file's contents.
+func hashFile(pathname string) (string, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
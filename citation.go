@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"JeffreyRichter.com/VectorDB/ingest"
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+// groundingData is a grounding as the prompt templates see it; groundings are numbered from 1 so
+// the model can cite them as [1], [2], etc.
+type groundingData struct {
+	Number              int
+	Score               float32
+	Source              string // The source document's file name; "" if unknown
+	FirstPage, LastPage int    // 0 if unknown
+	Text                string
+}
+
+func newGroundingData(groundings []vectordb.SearchResult) []groundingData {
+	gds := make([]groundingData, len(groundings))
+	for i, g := range groundings {
+		gds[i] = groundingData{Number: i + 1, Score: g.Score, Text: string(g.Entry.ID)}
+		if md, ok := g.Entry.Metadata.(*ingest.ChunkMetadata); ok {
+			gds[i].Source, gds[i].FirstPage, gds[i].LastPage = md.Source, md.FirstPage, md.LastPage
+		}
+	}
+	return gds
+}
+
+// Label describes where the grounding came from, for example "BoatSurvey.pdf, page 3".
+func (g groundingData) Label() string {
+	return sourceLabel(g.Source, g.FirstPage, g.LastPage)
+}
+
+func sourceLabel(source string, firstPage, lastPage int) string {
+	if source == "" {
+		source = "unknown source"
+	}
+	switch {
+	case firstPage == 0:
+		return source
+	case firstPage == lastPage:
+		return fmt.Sprintf("%s, page %d", source, firstPage)
+	default:
+		return fmt.Sprintf("%s, pages %d-%d", source, firstPage, lastPage)
+	}
+}
+
+var citationRegexp = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`) // [1] or [1, 2]
+
+// parseCitations returns the distinct grounding numbers cited by answer in order of first
+// citation; invalid holds cited numbers that don't identify one of the numGroundings groundings.
+func parseCitations(answer string, numGroundings int) (cited, invalid []int) {
+	for _, m := range citationRegexp.FindAllStringSubmatch(answer, -1) {
+		for _, s := range strings.Split(m[1], ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			switch {
+			case err != nil || slices.Contains(cited, n) || slices.Contains(invalid, n):
+			case n < 1 || n > numGroundings:
+				invalid = append(invalid, n)
+			default:
+				cited = append(cited, n)
+			}
+		}
+	}
+	return cited, invalid
+}
+
+// printReferences writes a footer listing the groundings answer cites & flags citations of
+// groundings that weren't provided to the model.
+func printReferences(w io.Writer, groundings []groundingData, answer string) (cited []int) {
+	cited, invalid := parseCitations(answer, len(groundings))
+	if len(cited) == 0 && len(invalid) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "\n\nReferences:\n")
+	for _, n := range cited {
+		fmt.Fprintf(w, "  [%d] %s\n", n, groundings[n-1].Label())
+	}
+	for _, n := range invalid {
+		fmt.Fprintf(w, "  %s[%d] cites a source that was not provided; treat the statement as unsupported%s\n", ForewardRed, n, ResetAllAttributes)
+	}
+	return cited
+}
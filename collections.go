@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+// A collectionStore keeps named vector DBs in a directory with one subdirectory per collection:
+//
+//	collection.json  The collection's collectionInfo
+//	entries.gob      A snapshot of the entries, in the same format as a createdb vector DB file
+//	changes.jsonl    Upserts & deletes made since the snapshot; each is synced to disk before it's acknowledged
+//
+// Opening a collection loads the snapshot & replays the changes; the changes are folded into a new
+// snapshot once there are compactAfter of them & when the store is closed.
+type collectionStore struct {
+	dir         string
+	mu          sync.RWMutex // Guards collections
+	collections map[string]*collection
+}
+
+const compactAfter = 1000
+
+var (
+	errCollectionNotFound = errors.New("collection not found")
+	errCollectionExists   = errors.New("collection already exists")
+	errEntryNotFound      = errors.New("entry not found")
+)
+
+var collectionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// collectionInfo describes a collection.
+type collectionInfo struct {
+	Name      string    `json:"name"`
+	Metric    string    `json:"metric"`    // A key of vectordb.Metrics
+	Dimension int       `json:"dimension"` // Length of every entry's vector
+	Created   time.Time `json:"created"`
+}
+
+type collection struct {
+	info    collectionInfo
+	dir     string
+	db      *vectordb.DB
+	mu      sync.Mutex // Serializes changes so the order they're logged in is the order they're applied in
+	changes changeLog
+	logged  int   // Number of changes in the log
+	broken  error // Set if a failed write couldn't be removed from the log; every later change fails with it
+}
+
+// changeLog is the part of *os.File a collection's changes.jsonl is used through; tests replace
+// it to simulate failed writes.
+type changeLog interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+// entryMetadata is the metadata of an entry added through the collections API. It's stored as
+// JSON because gob can't encode the arbitrary values JSON metadata may hold.
+type entryMetadata map[string]any
+
+func (m entryMetadata) GobEncode() ([]byte, error) { return json.Marshal(map[string]any(m)) }
+func (m *entryMetadata) GobDecode(data []byte) error {
+	return json.Unmarshal(data, (*map[string]any)(m))
+}
+
+func init() { gob.Register(entryMetadata{}) }
+
+// collectionChange is a line of changes.jsonl.
+type collectionChange struct {
+	Op       string        `json:"op"` // "upsert" or "delete"
+	ID       vectordb.ID   `json:"id"`
+	Vector   []float32     `json:"vector,omitempty"`
+	Metadata entryMetadata `json:"metadata,omitempty"`
+}
+
+// openCollectionStore opens the collections in dir, creating dir if it doesn't exist.
+func openCollectionStore(dir string) (*collectionStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &collectionStore{dir: dir, collections: map[string]*collection{}}
+	for _, de := range dirEntries {
+		if !de.IsDir() || !collectionNameRegexp.MatchString(de.Name()) {
+			continue
+		}
+		c, err := openCollection(filepath.Join(dir, de.Name()))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // The collection's creation never completed
+		}
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("collection %s: %w", de.Name(), err)
+		}
+		s.collections[c.info.Name] = c
+	}
+	return s, nil
+}
+
+func openCollection(dir string) (*collection, error) {
+	c := &collection{dir: dir}
+	data, err := os.ReadFile(filepath.Join(dir, "collection.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.info); err != nil {
+		return nil, err
+	}
+	metric, ok := vectordb.Metrics[c.info.Metric]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %q", c.info.Metric)
+	}
+
+	if c.db, err = vectordb.Load(filepath.Join(dir, "entries.gob"), metric); errors.Is(err, fs.ErrNotExist) {
+		c.db = vectordb.New(metric, nil) // Nothing has been compacted yet
+	} else if err != nil {
+		return nil, err
+	}
+
+	changes, err := os.OpenFile(filepath.Join(dir, "changes.jsonl"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	c.changes = changes
+	if err := c.replay(); err != nil {
+		c.changes.Close()
+		return nil, fmt.Errorf("changes.jsonl: %w", err)
+	}
+	return c, nil
+}
+
+// replay applies the logged changes to the DB & positions the log for appending. A last line
+// without a newline was being written when the process stopped so it was never acknowledged &
+// is dropped.
+func (c *collection) replay() error {
+	r, offset := bufio.NewReader(c.changes), int64(0)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		change := collectionChange{}
+		if err := json.Unmarshal(line, &change); err != nil {
+			return fmt.Errorf("%w: offset %d: %w", vectordb.ErrDBCorrupt, offset, err)
+		}
+		if err := c.apply(change); err != nil {
+			return fmt.Errorf("%w: offset %d: %w", vectordb.ErrDBCorrupt, offset, err)
+		}
+		offset += int64(len(line))
+		c.logged++
+	}
+	if err := c.changes.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := c.changes.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (c *collection) apply(change collectionChange) error {
+	switch change.Op {
+	case "upsert":
+		return c.db.Upsert(&vectordb.Entry{ID: change.ID, Metadata: change.Metadata, Vector: change.Vector})
+	case "delete":
+		c.db.Delete(change.ID)
+		return nil
+	default:
+		return fmt.Errorf("unknown change %q", change.Op)
+	}
+}
+
+// Change logs the changes durably & then applies them to the DB. An upsert's vector must have the
+// collection's dimension so that replaying the log can't fail.
+func (c *collection) Change(changes []collectionChange) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changes == nil {
+		return errCollectionNotFound // Deleted since it was looked up
+	}
+	if c.broken != nil {
+		return c.broken
+	}
+	for _, change := range changes {
+		if change.Op == "upsert" && len(change.Vector) != c.info.Dimension {
+			return fmt.Errorf("%w: entry %q has a %d-dimension vector but collection %s has %d",
+				vectordb.ErrDimensionMismatch, change.ID, len(change.Vector), c.info.Name, c.info.Dimension)
+		}
+	}
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, change := range changes {
+		if err := enc.Encode(change); err != nil {
+			return err
+		}
+	}
+	if err := c.log(buf.Bytes()); err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if err := c.apply(change); err != nil {
+			return err
+		}
+	}
+	if c.logged += len(changes); c.logged >= compactAfter {
+		return c.compact()
+	}
+	return nil
+}
+
+// log appends lines to the change log & syncs it. If that fails, whatever part of lines reached
+// the log is removed; otherwise later changes would be appended after a partial line & replay
+// would report the log as corrupt. If it can't be removed, the collection refuses further changes.
+func (c *collection) log(lines []byte) error {
+	offset, err := c.changes.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = c.changes.Write(lines)
+	if err == nil {
+		err = c.changes.Sync()
+	}
+	if err == nil {
+		return nil
+	}
+	if tErr := c.changes.Truncate(offset); tErr != nil {
+		c.broken = fmt.Errorf("collection %s's change log can't be repaired after a failed write: %w", c.info.Name, tErr)
+		return errors.Join(err, c.broken)
+	}
+	if _, sErr := c.changes.Seek(offset, io.SeekStart); sErr != nil {
+		c.broken = fmt.Errorf("collection %s's change log can't be repaired after a failed write: %w", c.info.Name, sErr)
+		return errors.Join(err, c.broken)
+	}
+	return err
+}
+
+// compact writes a snapshot of the DB & empties the change log.
+func (c *collection) compact() error {
+	if c.logged == 0 {
+		return nil
+	}
+	if err := c.db.Save(filepath.Join(c.dir, "entries.gob")); err != nil {
+		return err
+	}
+	if err := c.changes.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := c.changes.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	c.logged = 0
+	return nil
+}
+
+// close compacts the collection & closes its change log.
+func (c *collection) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changes == nil {
+		return nil
+	}
+	err := c.compact()
+	c.changes.Close()
+	c.changes = nil
+	return err
+}
+
+// List returns the collections sorted by name.
+func (s *collectionStore) List() []*collection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	collections := maps.Values(s.collections)
+	slices.SortFunc(collections, func(a, b *collection) bool { return a.info.Name < b.info.Name })
+	return collections
+}
+
+// Get returns the collection called name.
+func (s *collectionStore) Get(name string) (*collection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.collections[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errCollectionNotFound, name)
+	}
+	return c, nil
+}
+
+// Create creates an empty collection.
+func (s *collectionStore) Create(info collectionInfo) (*collection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.collections[info.Name]; ok {
+		return nil, fmt.Errorf("%w: %s", errCollectionExists, info.Name)
+	}
+	dir := filepath.Join(s.dir, info.Name)
+	if err := os.RemoveAll(dir); err != nil { // Left by a creation that never completed
+		return nil, err
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return nil, err
+	}
+	// collection.json is written last as its presence marks the collection as created
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	pathname := filepath.Join(dir, "collection.json")
+	if err := os.WriteFile(pathname+".tmp", data, 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(pathname+".tmp", pathname); err != nil {
+		return nil, err
+	}
+	c, err := openCollection(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.collections[info.Name] = c
+	return c, nil
+}
+
+// Delete deletes the collection called name along with its files.
+func (s *collectionStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.collections[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", errCollectionNotFound, name)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.changes.Close()
+	c.changes = nil
+	delete(s.collections, name)
+	// Remove collection.json first so a partially-removed directory is never reopened as a collection
+	if err := os.Remove(filepath.Join(c.dir, "collection.json")); err != nil {
+		return err
+	}
+	return os.RemoveAll(c.dir)
+}
+
+// Close compacts & closes every collection.
+func (s *collectionStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := []error{}
+	for _, c := range s.collections {
+		if err := c.close(); err != nil {
+			errs = append(errs, fmt.Errorf("collection %s: %w", c.info.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
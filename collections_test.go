@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+// failingLog simulates a disk that fails part way through an append: a torn write stores half
+// the bytes, a failed sync stores them all, & both report an error.
+type failingLog struct {
+	changeLog
+	torn bool
+}
+
+func (l failingLog) Write(p []byte) (int, error) {
+	if l.torn {
+		p = p[:len(p)/2]
+	}
+	n, _ := l.changeLog.Write(p)
+	return n, errors.New("disk full")
+}
+
+func (l failingLog) Sync() error { return errors.New("disk full") }
+
+func TestCollectionReopensAfterFailedWrite(t *testing.T) {
+	upsert := func(id string) []collectionChange {
+		return []collectionChange{{Op: "upsert", ID: vectordb.ID(id), Vector: []float32{1, 0}}}
+	}
+	for _, tc := range []struct {
+		name string
+		torn bool
+	}{
+		{"torn write", true},
+		{"failed sync", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := openCollectionStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := s.Create(collectionInfo{Name: "c", Metric: "cosine", Dimension: 2, Created: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Change(upsert("before")); err != nil {
+				t.Fatal(err)
+			}
+			good := c.changes
+			c.changes = failingLog{changeLog: good, torn: tc.torn}
+			if err := c.Change(upsert("failed")); err == nil {
+				t.Fatal("Change succeeded despite the failed write")
+			}
+			c.changes = good
+			if err := c.Change(upsert("after")); err != nil {
+				t.Fatal(err)
+			}
+			good.Close() // Simulate a crash: don't compact the log into a snapshot
+
+			s, err = openCollectionStore(dir)
+			if err != nil {
+				t.Fatalf("reopening the store: %v", err)
+			}
+			defer s.Close()
+			if c, err = s.Get("c"); err != nil {
+				t.Fatal(err)
+			}
+			for id, want := range map[vectordb.ID]bool{"before": true, "failed": false, "after": true} {
+				if _, got := c.db.Get(id); got != want {
+					t.Errorf("entry %q present = %v; want %v", id, got, want)
+				}
+			}
+		})
+	}
+}
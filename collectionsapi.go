@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+// handleCollections adds the endpoints managing the -collections store to mux:
+//
+//	GET    /collections                    Lists the collections
+//	POST   /collections                    {"name": "docs", "metric": "cosine", "dimension": 1536} creates a collection
+//	GET    /collections/{name}             Describes a collection
+//	DELETE /collections/{name}             Deletes a collection & its entries
+//	POST   /collections/{name}/entries     {"entries": [{"id": "...", "vector": [...] or "text": "...", "metadata": {...}}]} upserts entries
+//	GET    /collections/{name}/entries/{id}  Gets an entry; id is path-escaped
+//	DELETE /collections/{name}/entries/{id}  Deletes an entry
+//	POST   /collections/{name}/query       {"vector": [...] or "text": "...", "k": 10, "filter": {"key": value}} finds the nearest entries
+//
+// Text is embedded with -embedmodel & an entry with text but no id uses the text as its id, like
+// the entries made by createdb. Changes are on disk before they're acknowledged.
+func (s *ragServer) handleCollections(mux *http.ServeMux) {
+	mux.HandleFunc("/collections", s.collectionsHandler)
+	mux.HandleFunc("/collections/", s.collectionsHandler)
+}
+
+func (s *ragServer) collectionsHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<20) // Batches of vectors are large
+	err := s.routeCollections(w, r)
+	if err != nil {
+		writeError(w, err)
+	}
+	log.Printf("%s %s %v %v", r.Method, r.URL.Path, time.Since(start).Round(time.Millisecond), errorOrOK(err))
+}
+
+// routeCollections calls the handler for the request's path & method.
+func (s *ragServer) routeCollections(w http.ResponseWriter, r *http.Request) error {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), "/collections"), "/"), "/")
+	for i, p := range parts {
+		var err error
+		if parts[i], err = url.PathUnescape(p); err != nil {
+			return badRequest("invalid path: %v", err)
+		}
+	}
+	if parts[0] == "" {
+		parts = nil
+	}
+	route := func(methods map[string]func() error) error {
+		if h, ok := methods[r.Method]; ok {
+			return h()
+		}
+		allowed := maps.Keys(methods)
+		slices.Sort(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		return httpError{http.StatusMethodNotAllowed, fmt.Errorf("use %s", strings.Join(allowed, " or "))}
+	}
+
+	switch {
+	case len(parts) == 0:
+		return route(map[string]func() error{
+			http.MethodGet:  func() error { return s.listCollections(w) },
+			http.MethodPost: func() error { return s.createCollection(w, r) },
+		})
+	case len(parts) == 1:
+		return route(map[string]func() error{
+			http.MethodGet:    func() error { return s.getCollection(w, parts[0]) },
+			http.MethodDelete: func() error { return s.deleteCollection(w, parts[0]) },
+		})
+	case len(parts) == 2 && parts[1] == "entries":
+		return route(map[string]func() error{http.MethodPost: func() error { return s.upsertEntries(w, r, parts[0]) }})
+	case len(parts) == 3 && parts[1] == "entries":
+		return route(map[string]func() error{
+			http.MethodGet:    func() error { return s.getEntry(w, parts[0], vectordb.ID(parts[2])) },
+			http.MethodDelete: func() error { return s.deleteEntry(w, parts[0], vectordb.ID(parts[2])) },
+		})
+	case len(parts) == 2 && parts[1] == "query":
+		return route(map[string]func() error{http.MethodPost: func() error { return s.queryCollection(w, r, parts[0]) }})
+	default:
+		return httpError{http.StatusNotFound, errors.New("no such endpoint")}
+	}
+}
+
+// collectionSummary is a collection as listed & described by the API.
+type collectionSummary struct {
+	collectionInfo
+	Count int `json:"count"`
+}
+
+func newCollectionSummary(c *collection) collectionSummary {
+	return collectionSummary{c.info, c.db.Len()}
+}
+
+// collectionEntry is an entry as sent to & returned by the API.
+type collectionEntry struct {
+	ID       vectordb.ID   `json:"id"`
+	Score    *float32      `json:"score,omitempty"` // Only set for query results
+	Vector   []float32     `json:"vector,omitempty"`
+	Text     string        `json:"text,omitempty"` // Embedded when there's no vector; never returned
+	Metadata entryMetadata `json:"metadata,omitempty"`
+}
+
+func newCollectionEntry(e *vectordb.Entry, withVector bool) collectionEntry {
+	ce := collectionEntry{ID: e.ID}
+	if withVector {
+		ce.Vector = e.Vector
+	}
+	if md, ok := e.Metadata.(entryMetadata); ok {
+		ce.Metadata = md
+	}
+	return ce
+}
+
+func (s *ragServer) listCollections(w http.ResponseWriter) error {
+	summaries := []collectionSummary{}
+	for _, c := range s.collections.List() {
+		summaries = append(summaries, newCollectionSummary(c))
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Collections []collectionSummary `json:"collections"`
+	}{summaries})
+	return nil
+}
+
+func (s *ragServer) createCollection(w http.ResponseWriter, r *http.Request) error {
+	req := struct {
+		Name      string `json:"name"`
+		Metric    string `json:"metric"` // Defaults to cosine
+		Dimension int    `json:"dimension"`
+	}{}
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	if !collectionNameRegexp.MatchString(req.Name) {
+		return badRequest("name must be 1 to 64 letters, digits, '-' or '_'")
+	}
+	if req.Metric == "" {
+		req.Metric = "cosine"
+	}
+	if _, ok := vectordb.Metrics[req.Metric]; !ok {
+		return badRequest("metric must be cosine or dot")
+	}
+	if req.Dimension <= 0 {
+		return badRequest("dimension must be positive")
+	}
+	c, err := s.collections.Create(collectionInfo{Name: req.Name, Metric: req.Metric, Dimension: req.Dimension, Created: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, newCollectionSummary(c))
+	return nil
+}
+
+func (s *ragServer) getCollection(w http.ResponseWriter, name string) error {
+	c, err := s.collections.Get(name)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, newCollectionSummary(c))
+	return nil
+}
+
+func (s *ragServer) deleteCollection(w http.ResponseWriter, name string) error {
+	if err := s.collections.Delete(name); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// vectorsFor returns the vectors for the texts, checking they have the collection's dimension &
+// can be scored.
+func (s *ragServer) vectorsFor(r *http.Request, c *collection, texts []string) ([][]float32, error) {
+	vectors, err := s.embedder.Embed(r.Context(), texts)
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) > 0 && len(vectors[0]) != c.info.Dimension {
+		return nil, badRequest("%w: %s's vectors have %d dimensions but collection %s has %d", vectordb.ErrDimensionMismatch,
+			s.embedder.Model(), len(vectors[0]), c.info.Name, c.info.Dimension)
+	}
+	for i, v := range vectors {
+		if err := checkVector(v, c.info.Metric); err != nil {
+			return nil, badRequest("the vector of text %q %v", texts[i], err)
+		}
+	}
+	return vectors, nil
+}
+
+// checkVector returns an error if v's score under metric could be NaN or infinite, which JSON
+// can't represent: every metric needs the squares of v's components to sum to a finite number &
+// cosine similarity divides by v's length so it can't be 0.
+func checkVector(v []float32, metric string) error {
+	sumSquares := float32(0)
+	for _, x := range v {
+		sumSquares += x * x
+	}
+	switch {
+	case math.IsNaN(float64(sumSquares)) || math.IsInf(float64(sumSquares), 0):
+		return errors.New("has a component too large to score")
+	case sumSquares == 0 && metric == "cosine":
+		return errors.New("has no length so it has no cosine similarity")
+	}
+	return nil
+}
+
+func (s *ragServer) upsertEntries(w http.ResponseWriter, r *http.Request, name string) error {
+	c, err := s.collections.Get(name)
+	if err != nil {
+		return err
+	}
+	req := struct {
+		Entries []collectionEntry `json:"entries"`
+	}{}
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	if len(req.Entries) == 0 {
+		return badRequest("entries is required")
+	}
+
+	// Validate every entry before changing anything so a bad request changes nothing
+	texts, textEntries := []string{}, []int{}
+	for i, e := range req.Entries {
+		switch {
+		case e.Score != nil:
+			return badRequest("entries[%d]: score can't be set", i)
+		case e.Vector == nil && e.Text == "":
+			return badRequest("entries[%d]: vector or text is required", i)
+		case e.Vector != nil && len(e.Vector) != c.info.Dimension:
+			return badRequest("%w: entries[%d]: vector has %d dimensions but collection %s has %d", vectordb.ErrDimensionMismatch, i, len(e.Vector), c.info.Name, c.info.Dimension)
+		case e.Vector != nil && checkVector(e.Vector, c.info.Metric) != nil:
+			return badRequest("entries[%d]: vector %v", i, checkVector(e.Vector, c.info.Metric))
+		case e.ID == "" && e.Text == "":
+			return badRequest("entries[%d]: id is required", i)
+		}
+		if e.ID == "" {
+			req.Entries[i].ID = vectordb.ID(e.Text)
+		}
+		if e.Vector == nil {
+			texts, textEntries = append(texts, e.Text), append(textEntries, i)
+		}
+	}
+	if len(texts) > 0 {
+		vectors, err := s.vectorsFor(r, c, texts)
+		if err != nil {
+			return err
+		}
+		for i, v := range vectors {
+			req.Entries[textEntries[i]].Vector = v
+		}
+	}
+
+	changes := make([]collectionChange, len(req.Entries))
+	for i, e := range req.Entries {
+		changes[i] = collectionChange{Op: "upsert", ID: e.ID, Vector: e.Vector, Metadata: e.Metadata}
+	}
+	if err := c.Change(changes); err != nil {
+		return err
+	}
+	ids := make([]vectordb.ID, len(req.Entries))
+	for i, e := range req.Entries {
+		ids[i] = e.ID
+	}
+	writeJSON(w, http.StatusOK, struct {
+		IDs []vectordb.ID `json:"ids"` // In request order
+	}{ids})
+	return nil
+}
+
+func (s *ragServer) getEntry(w http.ResponseWriter, name string, id vectordb.ID) error {
+	c, err := s.collections.Get(name)
+	if err != nil {
+		return err
+	}
+	e, ok := c.db.Get(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", errEntryNotFound, id)
+	}
+	writeJSON(w, http.StatusOK, newCollectionEntry(e, true))
+	return nil
+}
+
+func (s *ragServer) deleteEntry(w http.ResponseWriter, name string, id vectordb.ID) error {
+	c, err := s.collections.Get(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.db.Get(id); !ok {
+		return fmt.Errorf("%w: %s", errEntryNotFound, id)
+	}
+	if err := c.Change([]collectionChange{{Op: "delete", ID: id}}); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *ragServer) queryCollection(w http.ResponseWriter, r *http.Request, name string) error {
+	c, err := s.collections.Get(name)
+	if err != nil {
+		return err
+	}
+	req := struct {
+		Vector         []float32      `json:"vector"`
+		Text           string         `json:"text"`
+		K              int            `json:"k"`              // Defaults to 10
+		Filter         map[string]any `json:"filter"`         // Only entries whose metadata has these values match
+		IncludeVectors bool           `json:"includeVectors"` // Return the entries' vectors
+	}{}
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	switch {
+	case (req.Vector == nil) == (req.Text == ""):
+		return badRequest("either vector or text is required")
+	case req.Vector != nil && len(req.Vector) != c.info.Dimension:
+		return badRequest("%w: vector has %d dimensions but collection %s has %d", vectordb.ErrDimensionMismatch, len(req.Vector), c.info.Name, c.info.Dimension)
+	case req.Vector != nil && checkVector(req.Vector, c.info.Metric) != nil:
+		return badRequest("vector %v", checkVector(req.Vector, c.info.Metric))
+	case req.K < 0:
+		return badRequest("k can't be negative")
+	case req.K > s.maxK:
+		return badRequest("k is %d but at most %d results may be requested", req.K, s.maxK)
+	case req.K == 0:
+		req.K = 10
+	}
+	if req.Vector == nil {
+		vectors, err := s.vectorsFor(r, c, []string{req.Text})
+		if err != nil {
+			return err
+		}
+		req.Vector = vectors[0]
+	}
+	var predicate func(e *vectordb.Entry) bool
+	if len(req.Filter) > 0 {
+		predicate = func(e *vectordb.Entry) bool {
+			md, _ := e.Metadata.(entryMetadata)
+			for k, v := range req.Filter {
+				if mv, ok := md[k]; !ok || !reflect.DeepEqual(mv, v) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	found, err := c.db.Query(req.Vector, req.K, predicate)
+	if err != nil {
+		return err
+	}
+	results := []collectionEntry{}
+	for _, sr := range found {
+		ce, score := newCollectionEntry(sr.Entry, req.IncludeVectors), sr.Score
+		ce.Score = &score
+		results = append(results, ce)
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Results []collectionEntry `json:"results"`
+	}{results})
+	return nil
+}
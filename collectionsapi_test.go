@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCheckVector(t *testing.T) {
+	nan, inf := float32(math.NaN()), float32(math.Inf(1))
+	for _, tc := range []struct {
+		name    string
+		vector  []float32
+		metric  string
+		wantErr bool
+	}{
+		{"cosine", []float32{1, 0}, "cosine", false},
+		{"cosine zero vector", []float32{0, 0}, "cosine", true},
+		{"cosine underflowing vector", []float32{1e-30, 0}, "cosine", true}, // Its square is 0 in float32
+		{"dot zero vector", []float32{0, 0}, "dot", false},
+		{"NaN", []float32{nan, 1}, "dot", true},
+		{"infinity", []float32{inf, 1}, "cosine", true},
+		{"overflowing square", []float32{3e19, 0}, "dot", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := checkVector(tc.vector, tc.metric); (err != nil) != tc.wantErr {
+				t.Fatalf("checkVector returned %v; want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings are layered; each layer overrides the ones before it:
+//  1. The flag's default value
+//  2. The config file's "defaults" section
+//  3. The config file's selected profile
+//  4. The VECTORDB_<FLAGNAME> environment variable
+//  5. The flag on the command line
+//
+// Config file keys are flag names so every flag can be set in any layer. An example config file:
+//
+//	profile: dev            # Profile used when neither -profile nor VECTORDB_PROFILE is set
+//	defaults:
+//	  url: https://openai-shared.openai.azure.com/
+//	  db: BoatSurvey.vdb
+//	  systemprompt: "@prompts/system.tmpl"
+//	  notcoveredmsg: "The {{.Topic}} manual doesn't say; try the manufacturer's support line."
+//	profiles:
+//	  dev:
+//	    chatmodel: gpt-35-turbo
+//	  prod:
+//	    auth: managedidentity
+//	  local-model:
+//	    chatprovider: openaicompat
+//	    chaturl: http://localhost:11434/v1
+//	    chatmodel: llama2
+type configFile struct {
+	Profile  string                    `yaml:"profile"`
+	Defaults map[string]any            `yaml:"defaults"`
+	Profiles map[string]map[string]any `yaml:"profiles"`
+}
+
+// secretFlags are the flags whose values are redacted when settings are shown.
+var secretFlags = map[string]bool{"apikey": true, "rerankapikey": true}
+
+type configParams struct {
+	pathname string
+	profile  string
+}
+
+// addConfigFlags adds the flags that select the config file & profile to cmd.
+func addConfigFlags(cmd *flag.FlagSet, p *configParams) {
+	cmd.StringVar(&p.pathname, "config", "", "path to the config file; defaults to ./vectordb.yaml or <user config dir>/VectorDB/config.yaml")
+	cmd.StringVar(&p.profile, "profile", "", "name of the config file profile to use")
+}
+
+// withEnv returns cfg with any unset fields taken from the environment.
+func (cfg configParams) withEnv() configParams {
+	if cfg.pathname == "" {
+		cfg.pathname = os.Getenv(envName("config"))
+	}
+	if cfg.profile == "" {
+		cfg.profile = os.Getenv(envName("profile"))
+	}
+	return cfg
+}
+
+func envName(flagName string) string { return "VECTORDB_" + strings.ToUpper(flagName) }
+
+// parseCmdLine parses arguments into cmd's flags & then layers the config file & environment
+// variables underneath any flags explicitly set on the command line. It returns applyConfig's error.
+func parseCmdLine(cmd *flag.FlagSet, arguments []string) error {
+	cfg := configParams{}
+	addConfigFlags(cmd, &cfg)
+	cmd.Parse(arguments)
+	_, err := applyConfig(cmd, cfg)
+	return err
+}
+
+// isFlagSet reports whether the flag called name was set on the command line, in a config file
+// or by an environment variable; parseCmdLine must have been called.
+func isFlagSet(cmd *flag.FlagSet, name string) (set bool) {
+	cmd.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
+}
+
+// applyConfig applies the config file & environment variable layers to cmd's flags & returns
+// where each flag's value came from. It returns an error wrapping errUsage if a setting or the
+// profile is invalid & loadConfigFile's error if the config file can't be loaded.
+func applyConfig(cmd *flag.FlagSet, cfg configParams) (sources map[string]string, err error) {
+	sources = map[string]string{}
+	explicit := map[string]string{} // Flags set on the command line
+	cmd.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
+
+	set := func(name, value, source string) error {
+		if cmd.Lookup(name) == nil {
+			return nil // The setting is for a different subcommand
+		}
+		if err := cmd.Set(name, value); err != nil {
+			return usageError("invalid value %q for %q from %s: %v", value, name, source, err)
+		}
+		sources[name] = source
+		return nil
+	}
+
+	cfg = cfg.withEnv()
+	profile := cfg.profile
+	file, pathname, ok, err := loadConfigFile(cfg.pathname)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if profile == "" {
+			profile = file.Profile
+		}
+		for name, value := range file.Defaults {
+			if err := set(name, fmt.Sprint(value), pathname); err != nil {
+				return nil, err
+			}
+		}
+		if profile != "" {
+			settings, ok := file.Profiles[profile]
+			if !ok {
+				return nil, usageError("profile %q not found in %q", profile, pathname)
+			}
+			for name, value := range settings {
+				if err := set(name, fmt.Sprint(value), fmt.Sprintf("%s (profile %s)", pathname, profile)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	} else if profile != "" {
+		return nil, usageError("profile %q specified but no config file found", profile)
+	}
+
+	cmd.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && err == nil {
+			err = set(f.Name, value, envName(f.Name))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range explicit {
+		if err := set(name, value, "command line"); err != nil {
+			return nil, err
+		}
+	}
+	return sources, nil
+}
+
+// loadConfigFile loads the config file at pathname or, if pathname is "", from the default
+// locations; ok is false if pathname is "" & there is no config file in the default locations.
+// It returns an error wrapping errUsage if the file isn't valid YAML.
+func loadConfigFile(pathname string) (file *configFile, loadedPathname string, ok bool, err error) {
+	candidates := []string{pathname}
+	if pathname == "" {
+		candidates = []string{"vectordb.yaml"}
+		if dir, err := os.UserConfigDir(); err == nil {
+			candidates = append(candidates, filepath.Join(dir, "VectorDB", "config.yaml"))
+		}
+	}
+	for _, candidate := range candidates {
+		data, err := os.ReadFile(candidate)
+		if pathname == "" && errors.Is(err, fs.ErrNotExist) {
+			continue // Default locations are optional
+		}
+		if err != nil {
+			return nil, "", false, fmt.Errorf("config file: %w", err)
+		}
+		file = &configFile{}
+		if err := yaml.Unmarshal(data, file); err != nil {
+			return nil, "", false, usageError("invalid config file %q: %v", candidate, err)
+		}
+		return file, candidate, true, nil
+	}
+	return nil, "", false, nil
+}
+
+func config(arguments []string) error {
+	if len(arguments) < 1 || arguments[0] != "show" {
+		return usageError("expected 'show' config subcommand")
+	}
+	cmd := flag.NewFlagSet("config show", flag.ExitOnError)
+	cfg := configParams{}
+	addConfigFlags(cmd, &cfg)
+	cmd.Parse(arguments[1:])
+
+	// Resolve the settings of every subcommand; most flags are shared so show each flag once
+	type setting struct{ value, source string }
+	settings := map[string]setting{}
+	for _, subcmd := range []*flag.FlagSet{newCreateDBCmd(&createDBCmdParams{}), newChatCmd(&chatCmdParams{}), newAskCmd(&askCmdParams{}), newServeCmd(&serveCmdParams{}), newCacheCmd("", &cacheCmdParams{})} {
+		sources, err := applyConfig(subcmd, cfg)
+		if err != nil {
+			return err
+		}
+		subcmd.VisitAll(func(f *flag.Flag) {
+			s := setting{value: f.Value.String(), source: sources[f.Name]}
+			if s.source == "" {
+				s.source = "default"
+			}
+			if secretFlags[f.Name] && s.value != "" {
+				s.value = "<redacted>"
+			}
+			settings[f.Name] = s
+		})
+	}
+
+	file, pathname, ok, err := loadConfigFile(cfg.withEnv().pathname)
+	if err != nil {
+		return err
+	}
+	if ok {
+		fmt.Printf("Config file: %s\n", pathname)
+		for _, section := range append([]map[string]any{file.Defaults}, maps.Values(file.Profiles)...) {
+			for name := range section {
+				if _, ok := settings[name]; !ok {
+					fmt.Printf("Warning: unknown setting %q is ignored\n", name)
+				}
+			}
+		}
+		fmt.Println()
+	} else {
+		fmt.Printf("Config file: none\n\n")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SETTING\tVALUE\tSOURCE")
+	names := maps.Keys(settings)
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, settings[name].value, settings[name].source)
+	}
+	return w.Flush()
+}
@@ -3,89 +3,152 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"io/fs"
 	"os"
-	"strings"
+	"os/signal"
+	"path/filepath"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/cognitiveservices/azopenai"
 	"github.com/ledongthuc/pdf"
 	"golang.org/x/exp/slices"
+
+	"JeffreyRichter.com/VectorDB/ingest"
+	"JeffreyRichter.com/VectorDB/vectordb"
 )
 
-func createDB(arguments []string) {
+func newCreateDBCmd(params *createDBCmdParams) *flag.FlagSet {
 	cmd := flag.NewFlagSet("createdb", flag.ExitOnError)
-	params := createDBCmdParams{}
 	cmd.StringVar(&params.srcPath, "src", "", "path to the source file used to create the vector DB")
 	cmd.StringVar(&params.dbPathname, "db", "", "path to the vector DB output file")
 	cmd.StringVar(&params.clientUrl, "url", "", "URL of the OpenAI service for embeddings")
-	cmd.StringVar(&params.clientAPIKey, "apikey", "", "API key used to authenticate against the OpenAI service")
-	cmd.Parse(arguments)
+	addAuthFlags(cmd, &params.auth)
+	addEmbedderFlags(cmd, &params.embedder)
+	addCacheFlags(cmd, &params.cacheDir, &params.cacheMaxMB)
+	cmd.IntVar(&params.chunkSize, "chunksize", 500, "number of words in each chunk")
+	cmd.IntVar(&params.chunkOverlap, "chunkoverlap", 100, "number of words each chunk shares with the previous chunk")
+	cmd.BoolVar(&params.resume, "resume", false, "resume from the checkpoint left by an interrupted run")
+	cmd.IntVar(&params.checkpointInterval, "checkpoint", 25, "number of chunks to embed between checkpoints")
+	return cmd
+}
 
-	kc, _ := azopenai.NewKeyCredential(params.clientAPIKey)
-	embedClient := must(azopenai.NewClientWithKeyCredential(params.clientUrl, kc, "text-embedding-ada-002-2", nil))
+func createDB(arguments []string) error {
+	params := createDBCmdParams{}
+	if err := parseCmdLine(newCreateDBCmd(&params), arguments); err != nil {
+		return err
+	}
+	if params.chunkOverlap >= params.chunkSize {
+		return usageError("-chunkoverlap must be less than -chunksize")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt) // Ctrl-C saves a checkpoint & stops
+	defer stop()
+	return buildDB(ctx, &params)
+}
+
+// buildDB embeds the chunks of the source document & saves them as the vector DB. If embedding
+// fails part way through, a checkpoint is saved so -resume can continue from it.
+func buildDB(ctx context.Context, params *createDBCmdParams) error {
+	cred, err := newServiceCredential(params.auth)
+	if err != nil {
+		return err
+	}
+	e, err := newEmbedder(params.embedder, params.clientUrl, cred)
+	if err != nil {
+		return err
+	}
+	embedder := newCachingEmbedder(e, newEmbeddingCache(params.cacheDir, params.cacheMaxMB<<20))
 
 	pdf.DebugOn = true
-	pdfFile, pdfReader, err := pdf.Open(params.srcPath)
-	must(0, err)
-	defer pdfFile.Close()
-	r := must(pdfReader.GetPlainText())
-	chunks := textSplitter(r, textSplitterOptions{chunkSize: 500, chunkOverlap: 100})
-	entries := []Entry{}
-	for _, chunk := range chunks {
+	pages, err := ingest.PDFPages(params.srcPath)
+	if err != nil {
+		return err
+	}
+	chunks, err := ingest.Split(pages, ingest.SplitterOptions{ChunkSize: params.chunkSize, ChunkOverlap: params.chunkOverlap})
+	if err != nil {
+		return err
+	}
+	chunkTexts := make([]string, len(chunks))
+	for i, c := range chunks {
+		chunkTexts[i] = c.Text
+	}
+
+	// Pick up where an interrupted run left off; the checkpoint is only valid for the same source & chunks
+	checkpointPath := checkpointPathname(params.dbPathname)
+	sourceHash, err := hashFile(params.srcPath)
+	if err != nil {
+		return err
+	}
+	cp := &checkpoint{SourceHash: sourceHash, Chunks: chunkTexts}
+	if params.resume {
+		if restored, ok, err := restoreCheckpoint(checkpointPath); err != nil {
+			return fmt.Errorf("checkpoint %s: %w", checkpointPath, err)
+		} else if !ok {
+			fmt.Printf("No checkpoint found at %q; starting from the beginning\n", checkpointPath)
+		} else if restored.SourceHash != cp.SourceHash || !slices.Equal(restored.Chunks, cp.Chunks) {
+			return usageError("checkpoint %q was created from a different source or with different chunking; delete it or run without -resume", checkpointPath)
+		} else {
+			cp = restored
+			fmt.Printf("Resuming after %d of %d chunks\n", len(cp.Entries), len(cp.Chunks))
+		}
+	}
+
+	source := filepath.Base(params.srcPath)
+	for _, chunk := range chunks[len(cp.Entries):] {
 		// TODO: This can be made more efficient by sending mutiple chunks in a single call up to max-token; see https://platform.openai.com/docs/api-reference/embeddings
-		response := must(embedClient.GetEmbeddings(context.TODO(), azopenai.EmbeddingsOptions{Input: []string{chunk}}, nil))
-		fmt.Println(chunk)
-		entries = append(entries, Entry{ID: ID(chunk), Metadata: nil, Vector: response.Embeddings.Data[0].Embedding})
+		vectors, err := embedder.Embed(ctx, []string{chunk.Text})
+		if err != nil {
+			if len(cp.Entries) > 0 {
+				if cpErr := saveCheckpoint(checkpointPath, cp); cpErr != nil {
+					return errors.Join(err, fmt.Errorf("saving the checkpoint: %w", cpErr))
+				}
+				fmt.Fprintf(os.Stderr, "Saved a checkpoint after %d of %d chunks; run again with -resume to continue\n", len(cp.Entries), len(cp.Chunks))
+			}
+			return err
+		}
+		fmt.Println(chunk.Text)
+		metadata := &ingest.ChunkMetadata{Source: source, FirstPage: chunk.FirstPage, LastPage: chunk.LastPage}
+		cp.Entries = append(cp.Entries, vectordb.Entry{ID: vectordb.ID(chunk.Text), Metadata: metadata, Vector: vectors[0]})
+		if params.checkpointInterval > 0 && len(cp.Entries)%params.checkpointInterval == 0 {
+			if err := saveCheckpoint(checkpointPath, cp); err != nil {
+				return fmt.Errorf("saving the checkpoint: %w", err)
+			}
+		}
+	}
+	entries := make([]*vectordb.Entry, len(cp.Entries))
+	for i := range cp.Entries {
+		entries[i] = &cp.Entries[i]
 	}
-	slices.SortFunc(entries, func(i, j Entry) bool { return i.ID < j.ID }) // Sort the entries by ID
+	slices.SortFunc(entries, func(i, j *vectordb.Entry) bool { return i.ID < j.ID }) // Sort the entries by ID
 
 	// Save the vectors to the DB file
-	f := must(os.Create(params.dbPathname))
-	defer f.Close()
-	must(0, gob.NewEncoder(f).Encode(entries))
-}
+	if err := vectordb.New(vectordb.CosineSimilarity{}, entries).Save(params.dbPathname); err != nil {
+		return err
+	}
 
-type createDBCmdParams struct {
-	srcPath      string
-	dbPathname   string
-	clientUrl    string // "https://openai-shared.openai.azure.com/"
-	clientAPIKey string
+	// The DB is complete so the checkpoint is no longer needed
+	if err := os.Remove(checkpointPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
 }
 
-type textSplitterOptions struct {
-	//sep          []string
-	chunkSize    int // Default=4000
-	chunkOverlap int // Default=200
-}
+type createDBCmdParams struct {
+	srcPath    string
+	dbPathname string
+	clientUrl  string // "https://openai-shared.openai.azure.com/"
+	auth       authParams
 
-func textSplitter(text io.Reader, o textSplitterOptions) []string {
-	// https://js.langchain.com/docs/modules/indexes/text_splitters/examples/recursive_character
-	// https://github.com/hwchase17/langchain/blob/master/langchain/text_splitter.py#L56
+	embedder   embedderParams
+	cacheDir   string
+	cacheMaxMB int64
 
-	// Split text into slice of words
-	words := []string{}
-	scanner := bufio.NewScanner(text)
-	scanner.Split(bufio.ScanWords)
-	for scanner.Scan() {
-		words = append(words, scanner.Text())
-	}
-	must(0, scanner.Err())
+	chunkSize    int
+	chunkOverlap int
 
-	chunks := []string{}
-	for index := 0; index < len(words[index:]); {
-		numWordsInChunk := len(words[index:]) // Grab at most chunkSize words into a chunk
-		if numWordsInChunk > o.chunkSize {
-			numWordsInChunk = o.chunkSize
-		}
-		chunks = append(chunks, strings.Join(words[index:index+numWordsInChunk], " "))
-		index += numWordsInChunk - o.chunkOverlap
-	}
-	return chunks
+	resume             bool
+	checkpointInterval int
 }
 
 //with "\n\n", then "\n", then " ". This
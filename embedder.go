@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/cognitiveservices/azopenai"
+)
+
+// Embedder turns text into embedding vectors. Vectors produced by different models are not
+// comparable so a DB must be queried with the same model that created it.
+type Embedder interface {
+	// Embed returns one vector per text in the same order as texts.
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+
+	// Model identifies the model producing the vectors.
+	Model() string
+
+	// Dimensions returns the length of the vectors returned by Embed; 0 means not known in advance.
+	Dimensions() int
+}
+
+var _, _, _ Embedder = (*azureEmbedder)(nil), (*openAIEmbedder)(nil), (*fakeEmbedder)(nil)
+
+type embedderParams struct {
+	provider   string // "azure", "openai", "openaicompat" or "fake"
+	url        string // Defaults to the command's -url if empty
+	model      string // Azure deployment name or OpenAI model name
+	dimensions int
+	timeout    time.Duration // Limits each request; 0 means no limit
+}
+
+// addEmbedderFlags adds the flags that select & configure the Embedder to cmd.
+func addEmbedderFlags(cmd *flag.FlagSet, p *embedderParams) {
+	cmd.StringVar(&p.provider, "embedprovider", "azure", "embedding provider: azure, openai, openaicompat (e.g. Ollama or llama.cpp) or fake")
+	cmd.StringVar(&p.url, "embedurl", "", "URL of the embedding service; defaults to -url")
+	cmd.StringVar(&p.model, "embedmodel", "text-embedding-ada-002-2", "embedding model (the deployment name for Azure OpenAI)")
+	cmd.IntVar(&p.dimensions, "embeddim", 0, "expected embedding vector length; 0 accepts whatever the model returns")
+	cmd.DurationVar(&p.timeout, "embedtimeout", time.Minute, "maximum time for each embedding request; 0 means no limit")
+}
+
+// newEmbedder creates the Embedder selected by p; url is used if p doesn't specify its own URL.
+// It returns an error wrapping errUsage if p is invalid.
+func newEmbedder(p embedderParams, url string, cred serviceCredential) (Embedder, error) {
+	if p.url != "" {
+		url = p.url
+	}
+	switch p.provider {
+	case "azure":
+		client, err := newAzureClient(url, cred, p.model)
+		if err != nil {
+			return nil, err
+		}
+		return &azureEmbedder{client: client, deployment: p.model, dimensions: p.dimensions, timeout: p.timeout}, nil
+	case "openai", "openaicompat":
+		if url == "" && p.provider == "openai" {
+			url = "https://api.openai.com/v1"
+		}
+		client, err := newOpenAIClient(url, cred)
+		if err != nil {
+			return nil, err
+		}
+		return &openAIEmbedder{client: client, model: p.model, dimensions: p.dimensions, timeout: p.timeout}, nil
+	case "fake":
+		dimensions := p.dimensions
+		if dimensions == 0 {
+			dimensions = 256
+		}
+		return &fakeEmbedder{dimensions: dimensions}, nil
+	default:
+		return nil, usageError("unknown embedding provider %q; expected azure, openai, openaicompat or fake", p.provider)
+	}
+}
+
+// embeddings extracts the vectors from an embeddings response in input order & verifies their length.
+func embeddings(resp azopenai.GetEmbeddingsResponse, numTexts int, dimensions int) ([][]float32, error) {
+	vectors := make([][]float32, numTexts)
+	for _, item := range resp.Data {
+		if item.Index == nil || int(*item.Index) >= numTexts {
+			return nil, fmt.Errorf("embedding service returned an unexpected index")
+		}
+		vectors[*item.Index] = item.Embedding
+	}
+	for i, v := range vectors {
+		switch {
+		case v == nil:
+			return nil, fmt.Errorf("embedding service returned no vector for input %d", i)
+		case dimensions != 0 && len(v) != dimensions:
+			return nil, fmt.Errorf("embedding service returned a %d-dimension vector; expected %d", len(v), dimensions)
+		}
+	}
+	return vectors, nil
+}
+
+// azureEmbedder embeds text using an Azure OpenAI embedding deployment.
+type azureEmbedder struct {
+	client     *azopenai.Client
+	deployment string
+	dimensions int
+	timeout    time.Duration
+}
+
+func (e *azureEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	ctx, cancel := withTimeout(ctx, e.timeout)
+	defer cancel()
+	resp, err := e.client.GetEmbeddings(ctx, azopenai.EmbeddingsOptions{Input: texts}, nil)
+	if err != nil {
+		return nil, normalizeServiceError(contextError(ctx, err))
+	}
+	return embeddings(resp, len(texts), e.dimensions)
+}
+
+func (e *azureEmbedder) Model() string   { return e.deployment }
+func (e *azureEmbedder) Dimensions() int { return e.dimensions }
+
+// openAIEmbedder embeds text using the public OpenAI API or any server implementing its
+// /embeddings endpoint (Ollama, llama.cpp, vLLM, etc.).
+type openAIEmbedder struct {
+	client     *azopenai.Client
+	model      string
+	dimensions int
+	timeout    time.Duration
+}
+
+func (e *openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	ctx, cancel := withTimeout(ctx, e.timeout)
+	defer cancel()
+	resp, err := e.client.GetEmbeddings(ctx, azopenai.EmbeddingsOptions{Input: texts, Model: to.Ptr(e.model)}, nil)
+	if err != nil {
+		return nil, normalizeServiceError(contextError(ctx, err))
+	}
+	return embeddings(resp, len(texts), e.dimensions)
+}
+
+func (e *openAIEmbedder) Model() string   { return e.model }
+func (e *openAIEmbedder) Dimensions() int { return e.dimensions }
+
+// fakeEmbedder is an in-process Embedder for tests & offline experiments. It hashes each word
+// into one of the vector's dimensions so texts sharing words have similar vectors.
+type fakeEmbedder struct {
+	dimensions int
+}
+
+func (e *fakeEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vector := make([]float32, e.dimensions)
+		for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+			h := fnv.New32a()
+			h.Write([]byte(word))
+			vector[h.Sum32()%uint32(e.dimensions)]++
+		}
+		magnitude := 0.0
+		for _, v := range vector {
+			magnitude += float64(v * v)
+		}
+		if magnitude > 0 { // Normalize so that DotProduct & CosineSimilarity agree
+			for k := range vector {
+				vector[k] /= float32(math.Sqrt(magnitude))
+			}
+		}
+		vectors[i] = vector
+	}
+	return vectors, nil
+}
+
+func (e *fakeEmbedder) Model() string   { return fmt.Sprintf("fake-%d", e.dimensions) }
+func (e *fakeEmbedder) Dimensions() int { return e.dimensions }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"JeffreyRichter.com/VectorDB/ingest"
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+// Exit codes; scripts can use them to tell failures that are worth retrying from ones that need
+// a different command line, credentials or data.
+const (
+	exitFailure     = 1   // Any error without a more specific code
+	exitUsage       = 2   // Invalid flags, arguments, templates or config file; the flag package also uses 2
+	exitAuth        = 3   // ErrAuth
+	exitService     = 4   // ErrRateLimited, ErrServiceUnavailable or a timeout; retrying later may succeed
+	exitData        = 5   // The vector DB, source document or question can't be used
+	exitNotFound    = 6   // A file or session doesn't exist
+	exitInterrupted = 130 // Ctrl-C, as shells report a process ended by SIGINT
+)
+
+// errUsage is wrapped by the errors reporting invalid flags, arguments, templates or config files.
+var errUsage = errors.New("invalid usage")
+
+// usageError returns an error wrapping errUsage with a message formatted like fmt.Sprintf.
+func usageError(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", errUsage, fmt.Sprintf(format, a...))
+}
+
+// exitCode returns the exit code reporting err.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, ErrAuth):
+		return exitAuth
+	case errors.Is(err, ErrRateLimited), errors.Is(err, ErrServiceUnavailable), errors.Is(err, context.DeadlineExceeded):
+		return exitService
+	case errors.Is(err, vectordb.ErrDBCorrupt), errors.Is(err, vectordb.ErrDimensionMismatch), errors.Is(err, ingest.ErrInvalidDocument),
+		errors.Is(err, ErrContextLengthExceeded), errors.Is(err, ErrContentFiltered):
+		return exitData
+	case errors.Is(err, fs.ErrNotExist):
+		return exitNotFound
+	default:
+		return exitFailure
+	}
+}
+
+// errorHint returns advice for fixing err; "" if there's none.
+func errorHint(err error) string {
+	switch {
+	case errors.Is(err, ErrAuth):
+		return "Check -apikey or, for Entra ID, -auth & that the identity has access to the service."
+	case errors.Is(err, ErrRateLimited):
+		return "Wait & try again; with ask -batch, lower -concurrency."
+	case errors.Is(err, ErrServiceUnavailable):
+		return "Check -url & that the service is running."
+	case errors.Is(err, context.DeadlineExceeded):
+		return "Try again or raise -chattimeout or -embedtimeout."
+	case errors.Is(err, vectordb.ErrDimensionMismatch):
+		return "Use the -embedprovider, -embedmodel & -embeddim the vector DB was created with."
+	case errors.Is(err, vectordb.ErrDBCorrupt):
+		return "Recreate the vector DB with createdb."
+	case errors.Is(err, ErrContextLengthExceeded):
+		return "Raise -contextwindow or lower -maxtokens or -k."
+	default:
+		return ""
+	}
+}
+
+// reportError prints err & any advice for fixing it to standard error.
+func reportError(err error) {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	if hint := errorHint(err); hint != "" {
+		fmt.Fprintln(os.Stderr, hint)
+	}
+}
+
+// exitOnError reports err & exits with its exit code if err isn't nil.
+func exitOnError(err error) {
+	if err != nil {
+		reportError(err)
+		os.Exit(exitCode(err))
+	}
+}
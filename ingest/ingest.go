@@ -0,0 +1,110 @@
+// Package ingest turns documents into the chunks of text that are embedded into a vector DB.
+//
+// https://abdullin.com/llm/how-to-segment-text-for-embeddings/
+// https://www.pinecone.io/learn/chunking-strategies/
+package ingest
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// ErrInvalidDocument is wrapped by the error PDFPages returns for a file that isn't a PDF it can read.
+var ErrInvalidDocument = errors.New("the document can't be read")
+
+// Chunk is a piece of a document's text & the pages it came from.
+type Chunk struct {
+	Text                string
+	FirstPage, LastPage int
+}
+
+// ChunkMetadata is the Metadata of each vectordb.Entry created from a Chunk; it identifies where
+// the chunk came from.
+type ChunkMetadata struct {
+	Source              string // The source document's file name
+	FirstPage, LastPage int    // 1-based; 0 if unknown
+}
+
+// Entry.Metadata is an interface so gob must know the concrete type; the name is the one vector DB
+// files were written with before this package existed.
+func init() { gob.RegisterName("*main.chunkMetadata", &ChunkMetadata{}) }
+
+// SplitterOptions configures Split.
+type SplitterOptions struct {
+	ChunkSize    int // Number of words in each chunk
+	ChunkOverlap int // Number of words each chunk shares with the previous chunk; less than ChunkSize
+}
+
+// PDFPages returns the plain text of each of the PDF's pages; pages[0] is page 1.
+func PDFPages(pathname string) (pages []string, err error) {
+	if _, err := os.Stat(pathname); err != nil {
+		return nil, err // Not ErrInvalidDocument so callers can tell a missing file from a bad one
+	}
+	defer func() { // The PDF package panics on many malformed PDFs
+		if r := recover(); r != nil {
+			pages, err = nil, fmt.Errorf("%w: %s: %v", ErrInvalidDocument, pathname, r)
+		}
+	}()
+	f, r, err := pdf.Open(pathname)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidDocument, pathname, err)
+	}
+	defer f.Close()
+	pages = make([]string, r.NumPage())
+	fonts := make(map[string]*pdf.Font)
+	for i := range pages {
+		p := r.Page(i + 1)
+		for _, name := range p.Fonts() { // cache fonts so we don't continually parse charmap
+			if _, ok := fonts[name]; !ok {
+				f := p.Font(name)
+				fonts[name] = &f
+			}
+		}
+		if pages[i], err = p.GetPlainText(fonts); err != nil {
+			return nil, fmt.Errorf("%w: %s: page %d: %w", ErrInvalidDocument, pathname, i+1, err)
+		}
+	}
+	return pages, nil
+}
+
+// Split splits the pages' text into chunks of o.ChunkSize words, each overlapping the previous
+// chunk by o.ChunkOverlap words.
+func Split(pages []string, o SplitterOptions) ([]Chunk, error) {
+	// https://js.langchain.com/docs/modules/indexes/text_splitters/examples/recursive_character
+	// https://github.com/hwchase17/langchain/blob/master/langchain/text_splitter.py#L56
+	if o.ChunkSize <= 0 || o.ChunkOverlap < 0 || o.ChunkOverlap >= o.ChunkSize {
+		return nil, errors.New("the chunk size must be positive & the chunk overlap must be less than it")
+	}
+
+	// Split text into slice of words, remembering which page each word is on
+	words, wordPages := []string{}, []int{}
+	for i, page := range pages {
+		scanner := bufio.NewScanner(strings.NewReader(page))
+		scanner.Split(bufio.ScanWords)
+		for scanner.Scan() {
+			words, wordPages = append(words, scanner.Text()), append(wordPages, i+1)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("page %d: %w", i+1, err)
+		}
+	}
+
+	chunks := []Chunk{}
+	for index := 0; index < len(words); index += o.ChunkSize - o.ChunkOverlap {
+		end := index + o.ChunkSize // Grab at most ChunkSize words into a chunk
+		if end > len(words) {
+			end = len(words)
+		}
+		chunks = append(chunks, Chunk{Text: strings.Join(words[index:end], " "), FirstPage: wordPages[index], LastPage: wordPages[end-1]})
+		if end == len(words) {
+			break // Any further chunk would only contain words already in this chunk
+		}
+	}
+	return chunks, nil
+}
@@ -0,0 +1,75 @@
+package ingest
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		pages   []string
+		o       SplitterOptions
+		want    []Chunk
+		wantErr bool
+	}{
+		{"no overlap", []string{"a b c d e"}, SplitterOptions{ChunkSize: 2}, []Chunk{
+			{"a b", 1, 1}, {"c d", 1, 1}, {"e", 1, 1},
+		}, false},
+		{"overlap", []string{"a b c d e"}, SplitterOptions{ChunkSize: 3, ChunkOverlap: 1}, []Chunk{
+			{"a b c", 1, 1}, {"c d e", 1, 1},
+		}, false},
+		// The last chunk reaches the end so no chunk of words already chunked follows it
+		{"last chunk ends the text", []string{"a b c d"}, SplitterOptions{ChunkSize: 3, ChunkOverlap: 2}, []Chunk{
+			{"a b c", 1, 1}, {"b c d", 1, 1},
+		}, false},
+		{"pages", []string{"a b", "", "c d e"}, SplitterOptions{ChunkSize: 3, ChunkOverlap: 1}, []Chunk{
+			{"a b c", 1, 3}, {"c d e", 3, 3},
+		}, false},
+		{"whitespace", []string{"  a\n\tb  "}, SplitterOptions{ChunkSize: 5}, []Chunk{{"a b", 1, 1}}, false},
+		{"no text", []string{"", " "}, SplitterOptions{ChunkSize: 5}, []Chunk{}, false},
+		{"overlap not less than size", []string{"a b"}, SplitterOptions{ChunkSize: 2, ChunkOverlap: 2}, nil, true},
+		{"zero size", []string{"a b"}, SplitterOptions{}, nil, true},
+		{"negative overlap", []string{"a b"}, SplitterOptions{ChunkSize: 2, ChunkOverlap: -1}, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks, err := Split(tc.pages, tc.o)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Split returned error %v; want error %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(chunks, tc.want) {
+				t.Fatalf("Split returned %v; want %v", chunks, tc.want)
+			}
+		})
+	}
+}
+
+func TestPDFPagesErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPDF := filepath.Join(dir, "notpdf.pdf")
+	if err := os.WriteFile(notPDF, []byte("plain text"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(dir, "truncated.pdf")
+	if err := os.WriteFile(truncated, []byte("%PDF-1.4\n1 0 obj\n<<"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, pathname string
+		wantErr        error
+	}{
+		{"missing", filepath.Join(dir, "missing.pdf"), fs.ErrNotExist},
+		{"not a PDF", notPDF, ErrInvalidDocument},
+		{"truncated", truncated, ErrInvalidDocument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := PDFPages(tc.pathname); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("PDFPages returned %v; want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
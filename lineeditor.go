@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/peterh/liner"
+)
+
+func defaultHistoryPathname() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "VectorDB", "history")
+}
+
+// addHistoryFlag adds the flag that specifies where typed questions are remembered to cmd.
+func addHistoryFlag(cmd *flag.FlagSet, pathname *string) {
+	cmd.StringVar(pathname, "history", defaultHistoryPathname(), "file recalling questions across chats with the up & down arrows; empty disables saving them")
+}
+
+// questionReader reads questions with line editing & history recall. A line ending in \ continues
+// on the next line & a line of """ starts or ends a block of lines for pasting multi-line text.
+type questionReader struct {
+	line    *liner.State
+	history string
+}
+
+func newQuestionReader(historyPathname string) *questionReader {
+	qr := &questionReader{line: liner.NewLiner(), history: historyPathname}
+	qr.line.SetCtrlCAborts(true)
+	qr.line.SetCompleter(func(line string) (completions []string) {
+		for _, c := range chatCommands {
+			if name := "/" + c.name; strings.HasPrefix(name, line) {
+				completions = append(completions, name)
+			}
+		}
+		return completions
+	})
+	if f, err := os.Open(historyPathname); err == nil {
+		qr.line.ReadHistory(f)
+		f.Close()
+	} else if historyPathname != "" && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("Warning: can't read the question history: %v\n", err)
+	}
+	return qr
+}
+
+// ReadQuestion returns the next question; it returns io.EOF if the user pressed Ctrl-D or Ctrl-C
+// at the prompt or standard input ended.
+func (qr *questionReader) ReadQuestion(prompt string) (string, error) {
+	lines, block := []string{}, false
+	for {
+		p := prompt
+		if len(lines) > 0 || block {
+			p = strings.Repeat(".", len(strings.TrimRight(prompt, " "))) + " " // Continuation prompt aligned with prompt
+		}
+		line, err := qr.line.Prompt(p)
+		if errors.Is(err, liner.ErrPromptAborted) {
+			err = io.EOF
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(lines) > 0 {
+				break // Standard input ended part way through a question; answer what was typed
+			}
+			return "", err
+		}
+
+		switch {
+		case strings.TrimSpace(line) == `"""`:
+			block = !block
+			if block {
+				continue
+			}
+		case block:
+			lines = append(lines, line)
+			continue
+		case strings.HasSuffix(line, `\`):
+			lines = append(lines, strings.TrimSuffix(line, `\`))
+			continue
+		default:
+			lines = append(lines, line)
+		}
+		break
+	}
+
+	question := strings.TrimSpace(strings.Join(lines, "\n"))
+	if question != "" {
+		qr.line.AppendHistory(strings.ReplaceAll(question, "\n", " ")) // History entries are single lines
+	}
+	return question, nil
+}
+
+// Close restores the terminal & saves the question history.
+func (qr *questionReader) Close() {
+	if qr.history != "" {
+		if err := os.MkdirAll(filepath.Dir(qr.history), 0o755); err == nil {
+			if f, err := os.Create(qr.history); err == nil {
+				qr.line.WriteHistory(f)
+				f.Close()
+			}
+		}
+	}
+	qr.line.Close()
+}
@@ -13,30 +13,46 @@ import (
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Expected 'createdb' or 'chat' subcommands")
-		os.Exit(1)
+		exitOnError(usageError("expected 'createdb', 'chat', 'ask', 'serve', 'sessions', 'cache' or 'config' subcommands"))
 	}
 
+	var err error
 	switch os.Args[1] { // Check which subcommand is invoked.
 	case "createdb":
-		createDB(os.Args[2:])
+		err = createDB(os.Args[2:])
 	case "chat":
-		chat(os.Args[2:])
+		err = chat(os.Args[2:])
+	case "ask":
+		err = ask(os.Args[2:])
+	case "serve":
+		err = serve(os.Args[2:])
+	case "sessions":
+		err = sessions(os.Args[2:])
+	case "cache":
+		err = cache(os.Args[2:])
+	case "config":
+		err = config(os.Args[2:])
 	default:
-		fmt.Println("Expected 'createdb' or 'chat' subcommands")
-		os.Exit(1)
+		err = usageError("expected 'createdb', 'chat', 'ask', 'serve', 'sessions', 'cache' or 'config' subcommands")
 	}
+	exitOnError(err)
 }
 
-func streaming() {
+func streaming() error {
 	// https://ms.portal.azure.com/#@microsoft.onmicrosoft.com/resource/subscriptions/faa080af-c1d8-40ad-9cce-e1a450ca5b57/resourceGroups/openai-shared/providers/Microsoft.CognitiveServices/accounts/openai-shared/cskeys
 	kc, _ := azopenai.NewKeyCredential("")
-	client := must(azopenai.NewClientWithKeyCredential("https://openai-shared.openai.azure.com/", kc, "ChatGPT", nil))
-	resp := must(client.GetCompletionsStream(context.TODO(), azopenai.CompletionsOptions{
+	client, err := azopenai.NewClientWithKeyCredential("https://openai-shared.openai.azure.com/", kc, "ChatGPT", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.GetCompletionsStream(context.TODO(), azopenai.CompletionsOptions{
 		Prompt:      []string{"What is Azure OpenAI?"},
 		MaxTokens:   to.Ptr(int32(2048)),
 		Temperature: to.Ptr(float32(0.0)),
-	}, nil))
+	}, nil)
+	if err != nil {
+		return err
+	}
 
 	for {
 		entry, err := resp.CompletionsStream.Read()
@@ -44,19 +60,15 @@ func streaming() {
 			fmt.Printf("\n *** NO MORE COMPLETIONS ***")
 			break
 		}
-		must(entry, err)
+		if err != nil {
+			return err
+		}
 
 		for _, choice := range entry.Choices {
 			fmt.Printf("%s", *choice.Text)
 		}
 	}
-}
-
-func must[R any](r R, err error) R {
-	if err != nil {
-		panic(err)
-	}
-	return r
+	return nil
 }
 
 type Cart struct {
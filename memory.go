@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+	"text/template"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/cognitiveservices/azopenai"
+
+	"JeffreyRichter.com/VectorDB/rag"
+)
+
+// ConversationMemory decides what a conversation remembers as it grows. Fit is called after
+// each turn to bring the conversation's history back within the memory's budget.
+type ConversationMemory interface {
+	Fit(ctx context.Context, cm *rag.Conversation) error
+}
+
+var _, _, _ ConversationMemory = (*dropOldestMemory)(nil), (*slidingWindowMemory)(nil), (*summarizingMemory)(nil)
+
+type memoryParams struct {
+	strategy string // "dropoldest", "summarize" or "slidingwindow"
+	tokens   int    // Token budget for the history (including any summary)
+	turns    int    // Number of question/answer turns kept by slidingwindow
+}
+
+// addMemoryFlags adds the flags that select & configure the ConversationMemory to cmd.
+func addMemoryFlags(cmd *flag.FlagSet, p *memoryParams) {
+	cmd.StringVar(&p.strategy, "memory", "dropoldest", "how a conversational chat forgets: dropoldest, summarize (folds old turns into a summary) or slidingwindow")
+	cmd.IntVar(&p.tokens, "memorytokens", 2000, "token budget for the conversation history used by dropoldest & summarize")
+	cmd.IntVar(&p.turns, "memoryturns", 5, "number of question/answer turns kept by slidingwindow")
+}
+
+// newConversationMemory creates the ConversationMemory selected by p; it returns an error
+// wrapping errUsage if p.strategy is unknown.
+func newConversationMemory(p memoryParams, pb *rag.PromptBuilder, model ChatModel) (ConversationMemory, error) {
+	switch p.strategy {
+	case "dropoldest":
+		return &dropOldestMemory{pb: pb, tokens: p.tokens}, nil
+	case "slidingwindow":
+		return &slidingWindowMemory{turns: p.turns}, nil
+	case "summarize":
+		return &summarizingMemory{pb: pb, tokens: p.tokens, model: model}, nil
+	default:
+		return nil, usageError("unknown memory strategy %q; expected dropoldest, summarize or slidingwindow", p.strategy)
+	}
+}
+
+// historyTokens returns the tokens used by cm's summary & conversation.
+func historyTokens(pb *rag.PromptBuilder, cm *rag.Conversation) int {
+	tokens := pb.MessageTokens(cm.History()...)
+	if summary := cm.SummaryMessage(); summary != nil {
+		tokens += pb.MessageTokens(*summary)
+	}
+	return tokens
+}
+
+// dropOldestMemory discards the oldest turns once the history exceeds its token budget.
+type dropOldestMemory struct {
+	pb     *rag.PromptBuilder
+	tokens int
+}
+
+func (m *dropOldestMemory) Fit(ctx context.Context, cm *rag.Conversation) error {
+	for len(cm.History()) > 0 && historyTokens(m.pb, cm) > m.tokens {
+		cm.RemoveFirstUserAndAssistantContent()
+	}
+	return nil
+}
+
+// slidingWindowMemory keeps only the most recent turns regardless of their size.
+type slidingWindowMemory struct {
+	turns int
+}
+
+func (m *slidingWindowMemory) Fit(ctx context.Context, cm *rag.Conversation) error {
+	for len(cm.History()) > 2*m.turns { // Each turn is a user & an assistant message
+		cm.RemoveFirstUserAndAssistantContent()
+	}
+	return nil
+}
+
+const summarizeMsg = `
+Progressively summarize the [CONVERSATION] between a user and an assistant, adding onto the [SUMMARY] so far, and return a new summary.
+Keep every fact, name, measurement, preference and decision the user established; leave out pleasantries.
+Respond with only the new summary.
+
+[SUMMARY]
+{{.Summary}}
+
+[CONVERSATION]
+{{range .Conversation}}{{.Role}}: {{.Content}}
+{{end}}`
+
+var summarizeMsgTmpl = template.Must(template.New("summarizeMsg").Parse(summarizeMsg))
+
+// summarizingMemory uses the model to fold the oldest turns into a rolling summary once the
+// history exceeds its token budget so facts established early in the conversation aren't lost.
+type summarizingMemory struct {
+	pb     *rag.PromptBuilder
+	tokens int
+	model  ChatModel
+}
+
+func (m *summarizingMemory) Fit(ctx context.Context, cm *rag.Conversation) error {
+	if historyTokens(m.pb, cm) <= m.tokens {
+		return nil
+	}
+
+	// Evict the oldest turns until the rest fits in half the budget; the summary gets the other half
+	evicted := []rag.Turn{}
+	for len(cm.History()) > 0 && m.pb.MessageTokens(cm.History()...) > m.tokens/2 {
+		number := len(cm.History())
+		if number > 2 {
+			number = 2
+		}
+		evicted = append(evicted, cm.Turns()[:number]...)
+		cm.RemoveFirstUserAndAssistantContent()
+	}
+	if len(evicted) == 0 {
+		return nil // Only the summary is over budget; it is limited when it's next rewritten
+	}
+
+	summarizePrompt, err := templateToString(summarizeMsgTmpl, struct {
+		Summary      string
+		Conversation []rag.Turn
+	}{cm.Summary(), evicted})
+	if err != nil {
+		return err
+	}
+	summary, err := complete(ctx, m.model, []azopenai.ChatMessage{{Role: to.Ptr(azopenai.ChatRoleUser), Content: &summarizePrompt}},
+		chatOptions{MaxTokens: int32(m.tokens / 2), Temperature: 0.0})
+	if err != nil {
+		return err
+	}
+	cm.SetSummary(strings.TrimSpace(summary))
+	return nil
+}
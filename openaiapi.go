@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"JeffreyRichter.com/VectorDB/rag"
+)
+
+// handleOpenAI adds the OpenAI-compatible endpoints to mux so tools speaking the OpenAI API get
+// grounded answers without changes:
+//
+//	POST /v1/chat/completions  The last user message is answered by the ragPipeline with earlier user &
+//	                           assistant messages as the conversation; the client's system messages are
+//	                           replaced by the system template & the request's model is ignored
+//	POST /v1/embeddings        Embeds with -embedmodel, using the embedding cache; this is also served
+//	                           with only -collections
+//	GET  /v1/models            Lists the chat model
+func (s *ragServer) handleOpenAI(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/chat/completions", s.handle(http.MethodPost, s.chatCompletions, writeOpenAIError))
+	if s.noRAG && s.embedder != nil { // There's no pipeline but the collections API's embedder can answer
+		tokens := rag.NewPromptBuilder(s.embedder.Model(), 0, 0)
+		mux.HandleFunc("/v1/embeddings", s.handleWithoutRAG(http.MethodPost, func(w http.ResponseWriter, r *http.Request) error {
+			return s.embeddings(w, r, s.embedder, tokens)
+		}, writeOpenAIError))
+	} else {
+		mux.HandleFunc("/v1/embeddings", s.handle(http.MethodPost, func(w http.ResponseWriter, r *http.Request, rp *ragPipeline) error {
+			return s.embeddings(w, r, rp.embedder, rp.prompts)
+		}, writeOpenAIError))
+	}
+	mux.HandleFunc("/v1/models", s.handle(http.MethodGet, s.models, writeOpenAIError))
+}
+
+// writeOpenAIError writes err the way the OpenAI API reports errors.
+func writeOpenAIError(w http.ResponseWriter, err error) {
+	status := httpStatus(err)
+	errorType := "server_error"
+	switch {
+	case status == http.StatusTooManyRequests:
+		errorType = "rate_limit_error"
+	case status < http.StatusInternalServerError:
+		errorType = "invalid_request_error"
+	}
+	body := struct {
+		Error openAIError `json:"error"`
+	}{openAIError{Message: err.Error(), Type: errorType}}
+	writeJSON(w, status, body)
+}
+
+type openAIError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+// openAIContent is a message's content: a string or an array of parts of which only text parts are used.
+type openAIContent string
+
+func (c *openAIContent) UnmarshalJSON(data []byte) error {
+	text := ""
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = openAIContent(text)
+		return nil
+	}
+	parts := []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}{}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts")
+	}
+	texts := []string{}
+	for _, p := range parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+	*c = openAIContent(strings.Join(texts, "\n"))
+	return nil
+}
+
+type openAIMessage struct {
+	Role    string        `json:"role"`
+	Content openAIContent `json:"content"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens,omitempty"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func newCompletionID() (string, error) {
+	b := [12]byte{}
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return "chatcmpl-" + hex.EncodeToString(b[:]), nil
+}
+
+func (s *ragServer) chatCompletions(w http.ResponseWriter, r *http.Request, rp *ragPipeline) error {
+	req := struct {
+		Model       string          `json:"model"`
+		Messages    []openAIMessage `json:"messages"`
+		Stream      bool            `json:"stream"`
+		Temperature *float32        `json:"temperature"`
+		MaxTokens   int             `json:"max_tokens"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { // Unknown fields are ignored as clients send many optional ones
+		return badRequest("invalid request body: %v", err)
+	}
+
+	// The last message must be the user's question; earlier user & assistant messages are the conversation
+	if len(req.Messages) == 0 || req.Messages[len(req.Messages)-1].Role != "user" {
+		return badRequest("the last message must have the user role")
+	}
+	cm, err := rp.NewConversation()
+	if err != nil {
+		return err
+	}
+	for _, m := range req.Messages[:len(req.Messages)-1] {
+		switch m.Role {
+		case "user":
+			cm.AddUserContent(string(m.Content))
+		case "assistant":
+			cm.AddAssistantContent(string(m.Content))
+		}
+	}
+	rr := ragRequest{Question: string(req.Messages[len(req.Messages)-1].Content), Conversation: cm, SessionID: "openai",
+		Temperature: req.Temperature, MaxTokens: req.MaxTokens}
+	id, err := newCompletionID()
+	if err != nil {
+		return err
+	}
+	created, model := time.Now().Unix(), rp.chatModel.Model()
+
+	if !req.Stream {
+		ans, err := rp.Answer(r.Context(), rr)
+		if err != nil {
+			return err
+		}
+		type choice struct {
+			Index        int           `json:"index"`
+			Message      openAIMessage `json:"message"`
+			FinishReason string        `json:"finish_reason"`
+		}
+		writeJSON(w, http.StatusOK, struct {
+			ID      string      `json:"id"`
+			Object  string      `json:"object"`
+			Created int64       `json:"created"`
+			Model   string      `json:"model"`
+			Choices []choice    `json:"choices"`
+			Usage   openAIUsage `json:"usage"`
+		}{id, "chat.completion", created, model,
+			[]choice{{Message: openAIMessage{Role: "assistant", Content: openAIContent(ans.Answer + referencesText(ans))}, FinishReason: finishReason(ans)}},
+			openAIUsage{ans.Usage.PromptTokens, ans.Usage.CompletionTokens, ans.Usage.TotalTokens}})
+		return nil
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming isn't supported by this connection")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	type delta struct {
+		Role    string `json:"role,omitempty"`
+		Content string `json:"content,omitempty"`
+	}
+	type choice struct {
+		Index        int     `json:"index"`
+		Delta        delta   `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	}
+	send := func(data any) {
+		b, err := json.Marshal(data)
+		if err != nil { // The status has been sent so the chunk can only be skipped
+			log.Printf("Encoding a chat completion chunk: %v", err)
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", b)
+		flusher.Flush()
+	}
+	sendChunk := func(d delta, finishReason *string) {
+		send(struct {
+			ID      string   `json:"id"`
+			Object  string   `json:"object"`
+			Created int64    `json:"created"`
+			Model   string   `json:"model"`
+			Choices []choice `json:"choices"`
+		}{id, "chat.completion.chunk", created, model, []choice{{Delta: d, FinishReason: finishReason}}})
+	}
+	sendChunk(delta{Role: "assistant"}, nil)
+	rr.Content = func(content string) { sendChunk(delta{Content: content}, nil) }
+	ans, err := rp.Answer(r.Context(), rr)
+	if err != nil { // The status has been sent so report the error in the stream
+		send(struct {
+			Error openAIError `json:"error"`
+		}{openAIError{Message: err.Error(), Type: "server_error"}})
+		return nil
+	}
+	if refs := referencesText(ans); refs != "" {
+		sendChunk(delta{Content: refs}, nil)
+	}
+	reason := finishReason(ans)
+	sendChunk(delta{}, &reason)
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+	return nil
+}
+
+// finishReason returns why the answer ended the way the OpenAI API reports it.
+func finishReason(ans *ragAnswer) string {
+	if ans.MaxTokens {
+		return "length"
+	}
+	return "stop"
+}
+
+// referencesText is a footer for an answer's content listing the groundings it cites, as OpenAI
+// clients have nowhere else to show them.
+func referencesText(ans *ragAnswer) string {
+	if len(ans.Cited) == 0 {
+		return ""
+	}
+	sb := &strings.Builder{}
+	sb.WriteString("\n\nReferences:\n")
+	for _, n := range ans.Cited {
+		fmt.Fprintf(sb, "[%d] %s\n", n, ans.Groundings[n-1].Label())
+	}
+	return sb.String()
+}
+
+// embeddings embeds the request's input with embedder; tokens counts the input for the usage.
+func (s *ragServer) embeddings(w http.ResponseWriter, r *http.Request, embedder Embedder, tokens *rag.PromptBuilder) error {
+	req := struct {
+		Input json.RawMessage `json:"input"`
+		Model string          `json:"model"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return badRequest("invalid request body: %v", err)
+	}
+	inputs := []string{}
+	if err := json.Unmarshal(req.Input, &inputs); err != nil {
+		input := ""
+		if err := json.Unmarshal(req.Input, &input); err != nil {
+			return badRequest("input must be a string or an array of strings")
+		}
+		inputs = []string{input}
+	}
+	if len(inputs) == 0 {
+		return badRequest("input is required")
+	}
+	vectors, err := embedder.Embed(r.Context(), inputs)
+	if err != nil {
+		return err
+	}
+
+	type embedding struct {
+		Object    string    `json:"object"`
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	}
+	data, usage := make([]embedding, len(vectors)), 0
+	for i, v := range vectors {
+		data[i] = embedding{Object: "embedding", Index: i, Embedding: v}
+		usage += tokens.Tokens(inputs[i])
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Object string      `json:"object"`
+		Data   []embedding `json:"data"`
+		Model  string      `json:"model"`
+		Usage  openAIUsage `json:"usage"`
+	}{"list", data, embedder.Model(), openAIUsage{PromptTokens: usage, TotalTokens: usage}})
+	return nil
+}
+
+func (s *ragServer) models(w http.ResponseWriter, r *http.Request, rp *ragPipeline) error {
+	type model struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		OwnedBy string `json:"owned_by"`
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Object string  `json:"object"`
+		Data   []model `json:"data"`
+	}{"list", []model{{ID: rp.chatModel.Model(), Object: "model", OwnedBy: "vectordb"}}})
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/cognitiveservices/azopenai"
+
+	"JeffreyRichter.com/VectorDB/rag"
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+// ragParams configures the retrieval-augmented generation pipeline shared by the subcommands
+// that answer questions.
+type ragParams struct {
+	dbPathname string
+	clientUrl  string
+	auth       authParams
+	embedder   embedderParams
+	chatModel  chatModelParams
+	cacheDir   string
+	cacheMaxMB int64
+
+	topic         string
+	maxGroundings int
+	temperature   float64
+	maxTokens     int
+	contextWindow int
+	templates     templateParams
+	relevance     relevanceParams
+	retrieval     retrievalParams
+	rerank        rerankParams
+	verify        verifyParams
+}
+
+// addRAGFlags adds the flags that configure the pipeline answering questions to cmd.
+func addRAGFlags(cmd *flag.FlagSet, p *ragParams) {
+	cmd.StringVar(&p.dbPathname, "db", "", "path to the existing vector DB file")
+	cmd.StringVar(&p.clientUrl, "url", "", "URL of the OpenAI service for embeddings & chat")
+	addAuthFlags(cmd, &p.auth)
+	addEmbedderFlags(cmd, &p.embedder)
+	addChatModelFlags(cmd, &p.chatModel)
+	addCacheFlags(cmd, &p.cacheDir, &p.cacheMaxMB)
+	cmd.StringVar(&p.topic, "topic", "Boat Survey", "topic of the document, {{.Topic}} in the prompt templates")
+	cmd.IntVar(&p.maxGroundings, "k", 5, "maximum number of groundings retrieved from the vector DB for each question")
+	cmd.Float64Var(&p.temperature, "temperature", 0.0, "sampling temperature of the chat model")
+	cmd.IntVar(&p.maxTokens, "maxtokens", 2048, "maximum number of tokens in each answer")
+	cmd.IntVar(&p.contextWindow, "contextwindow", 8192, "number of tokens the chat model accepts, including the answer")
+	addTemplateFlags(cmd, &p.templates)
+	addRelevanceFlags(cmd, &p.relevance)
+	addRetrievalFlags(cmd, &p.retrieval)
+	addRerankFlags(cmd, &p.rerank)
+	addVerifyFlags(cmd, &p.verify)
+}
+
+// ragPipeline answers questions about a vector DB: it retrieves groundings for a question, asks
+// the chat model to answer from them & checks the answer's citations & claims. A ragPipeline may
+// answer several questions concurrently.
+type ragPipeline struct {
+	params    *ragParams // Changes take effect on the next question
+	cred      serviceCredential
+	db        *vectordb.DB
+	embedder  Embedder
+	chatModel ChatModel
+	prompts   *rag.PromptBuilder
+	verifier  *answerVerifier
+	reranker  Reranker
+	templates *promptTemplates
+}
+
+// newRAGPipeline returns a pipeline answering questions about the -db vector DB. Invalid flags
+// return an error wrapping errUsage, which is returned before anything slow is done.
+func newRAGPipeline(p *ragParams) (*ragPipeline, error) {
+	if err := validateRetrievalMode(p.retrieval.mode); err != nil {
+		return nil, err
+	}
+	if p.relevance.gapLog == "" {
+		p.relevance.gapLog = p.dbPathname + ".gaps.jsonl"
+	}
+	rp := &ragPipeline{params: p}
+	templates, err := loadPromptTemplates(p.templates, p.relevance.notCoveredMsg) // Validate the templates before doing anything slow
+	if err != nil {
+		return nil, err
+	}
+	rp.templates = templates
+	if rp.cred, err = newServiceCredential(p.auth); err != nil {
+		return nil, err
+	}
+	embedder, err := newEmbedder(p.embedder, p.clientUrl, rp.cred)
+	if err != nil {
+		return nil, err
+	}
+	rp.embedder = newCachingEmbedder(embedder, newEmbeddingCache(p.cacheDir, p.cacheMaxMB<<20))
+	db, err := vectordb.Load(p.dbPathname, vectordb.CosineSimilarity{}) // The entries are sorted by ID by the "CreateDB" command
+	if err != nil {
+		return nil, err
+	}
+	rp.db = db
+	if d := p.embedder.dimensions; d != 0 && db.Dimensions() != 0 && d != db.Dimensions() {
+		return nil, fmt.Errorf("%w: -embeddim is %d but %s's vectors have %d dimensions", vectordb.ErrDimensionMismatch, d, p.dbPathname, db.Dimensions())
+	}
+	if err := rp.SetChatModel(p.chatModel.model); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// SetChatModel switches to the chat model called model along with everything that depends on it.
+// If it returns an error, the pipeline keeps using the previous model.
+func (rp *ragPipeline) SetChatModel(model string) error {
+	cmp := rp.params.chatModel
+	cmp.model = model
+	chatModel, err := newChatModel(cmp, rp.params.clientUrl, rp.cred)
+	if err != nil {
+		return err
+	}
+	verifier, err := newAnswerVerifier(rp.params.verify, rp.embedder, chatModel)
+	if err != nil {
+		return err
+	}
+	reranker, err := newReranker(rp.params.rerank, chatModel)
+	if err != nil {
+		return err
+	}
+	prompts := rag.NewPromptBuilder(chatModel.Model(), rp.params.contextWindow, rp.params.maxTokens)
+	if prompts.Estimated() {
+		log.Printf("Warning: %s's token encoding couldn't be loaded; estimating tokens from text length", chatModel.Model())
+	}
+	rp.params.chatModel, rp.chatModel, rp.prompts, rp.verifier, rp.reranker = cmp, chatModel, prompts, verifier, reranker
+	return nil
+}
+
+// NewConversation returns the messages for a new conversation, starting with the system message.
+func (rp *ragPipeline) NewConversation() (*rag.Conversation, error) {
+	system, err := templateToString(rp.templates.system, newPromptData(rp.params.topic))
+	if err != nil {
+		return nil, err
+	}
+	return rag.NewConversation(system), nil
+}
+
+// Search returns the k chunks most similar to query that match filter, best first.
+func (rp *ragPipeline) Search(ctx context.Context, query string, k int, filter chatFilter) ([]groundingData, error) {
+	vectors, err := rp.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	results, err := rp.db.Query(vectors[0], k, filter.predicate)
+	if err != nil {
+		return nil, err
+	}
+	return newGroundingData(results), nil
+}
+
+// ragRequest is a question for ragPipeline.Answer.
+type ragRequest struct {
+	Question     string
+	Conversation *rag.Conversation // Earlier turns, if any, are condensed into the search query & sent to the model
+	SessionID    string            // Recorded in the gap log
+	K            int               // Maximum number of groundings; 0 uses -k
+	Filter       chatFilter        // Restricts the chunks retrieved
+	Temperature  *float32          // nil uses -temperature
+	MaxTokens    int               // Maximum tokens in the answer; 0 (or more than -maxtokens) uses -maxtokens
+
+	// Optional callbacks reporting progress; Content receives each piece of the streamed answer.
+	Searching func(searchQuery string, expansions []string)
+	Content   func(content string)
+}
+
+// ragAnswer is the result of ragPipeline.Answer.
+type ragAnswer struct {
+	Question         string
+	SearchQuery      string   // The question rewritten using the conversation; the question if there was no conversation
+	Expansions       []string // Additional queries searched for by -retrieval=multiquery or hyde
+	Answer           string
+	NotCovered       bool // No grounding reached -minscore so the answer is the not-covered message
+	Truncated        bool // The answer was cut short by cancellation or a timeout
+	MaxTokens        bool // The answer was cut short by reaching the max tokens
+	Groundings       []groundingData
+	Cited            []int
+	InvalidCitations []int // Cited numbers that don't identify a grounding
+	Verification     *verification
+	Breakdown        rag.PromptBreakdown
+	Usage            tokenUsage
+}
+
+// tokenUsage is the estimated number of tokens used by the request generating the answer.
+type tokenUsage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	TotalTokens      int `json:"totalTokens"`
+}
+
+// Answer answers req.Question; it doesn't add the question or answer to req.Conversation but it
+// drops the conversation's oldest turns if they no longer fit in the context window. If the
+// answer is interrupted while streaming, Answer returns the partial answer marked as truncated
+// along with the interruption's error. If the prompt can't fit the context window, Answer returns
+// the breakdown of the prompt along with an error wrapping ErrContextLengthExceeded. If the answer
+// can't be verified, Answer still returns it with the reason in its Verification's Error.
+func (rp *ragPipeline) Answer(ctx context.Context, req ragRequest) (*ragAnswer, error) {
+	params, cm := rp.params, req.Conversation
+	ans := &ragAnswer{Question: req.Question, SearchQuery: req.Question}
+	if len(cm.History()) > 0 {
+		// Rewrite the follow-up question into a standalone search query; the answer still sees the real conversation
+		data := newPromptData(params.topic)
+		data.Question, data.History = req.Question, cm.Turns()
+		condensePrompt, err := templateToString(rp.templates.condense, data)
+		if err != nil {
+			return nil, err
+		}
+		condensed, err := complete(ctx, rp.chatModel, []azopenai.ChatMessage{{Role: to.Ptr(azopenai.ChatRoleUser), Content: &condensePrompt}},
+			chatOptions{MaxTokens: 256, Temperature: 0.0})
+		if err != nil {
+			return nil, err
+		}
+		ans.SearchQuery = strings.TrimSpace(condensed)
+	}
+
+	// Get embedding vectors for the search query & any expansions of it
+	queries, err := expandQuery(ctx, params.retrieval, rp.chatModel, params.topic, ans.SearchQuery)
+	if err != nil {
+		return nil, err
+	}
+	ans.Expansions = queries[1:]
+	if req.Searching != nil {
+		req.Searching(ans.SearchQuery, ans.Expansions)
+	}
+	queryVectors, err := rp.embedder.Embed(ctx, queries)
+	if err != nil {
+		return nil, err
+	}
+	k := req.K
+	if k <= 0 {
+		k = params.maxGroundings
+	}
+	numCandidates := k
+	if rp.reranker != nil && params.rerank.candidates > numCandidates {
+		numCandidates = params.rerank.candidates
+	}
+	results := make([][]vectordb.SearchResult, len(queryVectors))
+	for i, v := range queryVectors {
+		if results[i], err = rp.db.Query(v, numCandidates, req.Filter.predicate); err != nil {
+			return nil, err
+		}
+	}
+	groundings := fuseResults(results, numCandidates)
+	relevant := relevantGroundings(groundings, params.relevance.minScore)
+	if rp.reranker != nil && len(relevant) > 0 {
+		if relevant, err = rerank(ctx, rp.reranker, ans.SearchQuery, relevant, k); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(relevant) == 0 && params.relevance.minScore > 0 {
+		// Nothing in the document is relevant enough; don't let the model answer from irrelevant chunks
+		data := newPromptData(params.topic)
+		data.Question, data.History = req.Question, cm.Turns()
+		if ans.Answer, err = templateToString(rp.templates.notCovered, data); err != nil {
+			return nil, err
+		}
+		ans.NotCovered = true
+		if req.Content != nil {
+			req.Content(ans.Answer)
+		}
+		bestScore := float32(0)
+		for _, g := range groundings {
+			if g.Score > bestScore {
+				bestScore = g.Score
+			}
+		}
+		if err := logGap(params.relevance.gapLog, gapEvent{Time: time.Now(), DB: params.dbPathname, Session: req.SessionID,
+			Question: req.Question, SearchQuery: ans.SearchQuery, BestScore: bestScore, MinScore: params.relevance.minScore}); err != nil {
+			log.Printf("Warning: logging the corpus gap: %v", err) // The gap log is for analysis; it mustn't fail the answer
+		}
+		return ans, nil
+	}
+
+	p, err := rp.prompts.Build(cm, relevant, func(groundings []vectordb.SearchResult) (string, error) {
+		data := newPromptData(params.topic)
+		data.Question, data.Groundings, data.History = req.Question, newGroundingData(groundings), cm.Turns()
+		return templateToString(rp.templates.user, data)
+	})
+	ans.Breakdown = p.Breakdown
+	if err != nil {
+		return ans, err
+	}
+	ans.Groundings = newGroundingData(p.Groundings)
+
+	// Send the chat messages to the AI service
+	o := chatOptions{MaxTokens: int32(params.maxTokens), Temperature: float32(params.temperature)}
+	if req.MaxTokens > 0 && req.MaxTokens < params.maxTokens { // The prompt only reserves -maxtokens for the answer
+		o.MaxTokens = int32(req.MaxTokens)
+	}
+	if req.Temperature != nil {
+		o.Temperature = *req.Temperature
+	}
+	chatStream, err := rp.chatModel.StreamChat(ctx, p.Messages, o)
+	if err != nil {
+		return nil, err
+	}
+	var interrupted error
+	for {
+		content, err := chatStream.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				ans.MaxTokens = errors.Is(err, errMaxTokens)
+				break
+			}
+			if ctx.Err() == nil && !errors.Is(err, context.DeadlineExceeded) {
+				chatStream.Close()
+				return nil, err
+			}
+			interrupted = err // Keep what was streamed before the interruption
+			break
+		}
+		if req.Content != nil {
+			req.Content(content)
+		}
+		ans.Answer += content
+	}
+	chatStream.Close()
+	ans.Truncated = interrupted != nil
+	ans.Cited, ans.InvalidCitations = parseCitations(ans.Answer, len(ans.Groundings))
+	ans.Usage.PromptTokens = p.Breakdown.Total() - p.Breakdown.Reserved
+	ans.Usage.CompletionTokens = rp.prompts.Tokens(ans.Answer)
+	ans.Usage.TotalTokens = ans.Usage.PromptTokens + ans.Usage.CompletionTokens
+	if interrupted != nil {
+		return ans, interrupted // A partial answer's claims can't be judged fairly
+	}
+
+	groundingVectors := make([][]float32, len(p.Groundings))
+	for i, g := range p.Groundings {
+		groundingVectors[i] = g.Entry.Vector
+	}
+	if ans.Verification, err = rp.verifier.Verify(ctx, ans.Answer, ans.Groundings, groundingVectors); err != nil {
+		ans.Verification = &verification{Error: err.Error()} // Verification is optional; it mustn't discard an answer already given
+	}
+	return ans, nil
+}
@@ -0,0 +1,100 @@
+// Package rag holds the building blocks of retrieval-augmented generation: the Conversation sent
+// to a chat model & the PromptBuilder that fits a conversation, groundings retrieved from a
+// vectordb.DB & a question into the model's context window.
+package rag
+
+import (
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/cognitiveservices/azopenai"
+	"golang.org/x/exp/slices"
+)
+
+// Conversation is the chat messages sent to a chat model: a system message, an optional summary
+// of earlier turns & the user & assistant messages of the conversation so far.
+// https://platform.openai.com/docs/api-reference/chat/create
+type Conversation struct {
+	system       *azopenai.ChatMessage
+	summary      *azopenai.ChatMessage // Summary of turns evicted from conversation
+	conversation []azopenai.ChatMessage
+}
+
+// NewConversation returns a conversation starting with a system message of systemContent.
+func NewConversation(systemContent string) *Conversation {
+	return &Conversation{system: &azopenai.ChatMessage{Role: to.Ptr(azopenai.ChatRoleSystem), Content: &systemContent}}
+}
+
+// AddUserContent appends a user message of userContent to the conversation.
+func (c *Conversation) AddUserContent(userContent string) {
+	c.conversation = append(c.conversation, azopenai.ChatMessage{Role: to.Ptr(azopenai.ChatRoleUser), Content: &userContent})
+}
+
+// AddAssistantContent appends an assistant message of assistantContent to the conversation; it
+// follows the user message it answers.
+func (c *Conversation) AddAssistantContent(assistantContent string) {
+	c.conversation = append(c.conversation, azopenai.ChatMessage{Role: to.Ptr(azopenai.ChatRoleAssistant), Content: &assistantContent})
+}
+
+// RemoveFirstUserAndAssistantContent removes the oldest turn.
+func (c *Conversation) RemoveFirstUserAndAssistantContent() {
+	number := len(c.conversation)
+	if number > 2 {
+		number = 2
+	}
+	c.conversation = slices.Delete(c.conversation, 0, number)
+}
+
+// ResetConversation removes the summary & every turn, keeping the system message.
+func (c *Conversation) ResetConversation() {
+	c.summary = nil
+	c.conversation = []azopenai.ChatMessage{}
+}
+
+// SetSummary replaces the summary of the earlier conversation; it is sent as a system message.
+func (c *Conversation) SetSummary(summary string) {
+	content := "[SUMMARY OF EARLIER CONVERSATION]\n" + summary
+	c.summary = &azopenai.ChatMessage{Role: to.Ptr(azopenai.ChatRoleSystem), Content: &content}
+}
+
+// Summary returns the summary of the earlier conversation set by SetSummary; "" if there is none.
+func (c *Conversation) Summary() string {
+	if c.summary == nil {
+		return ""
+	}
+	return strings.TrimPrefix(*c.summary.Content, "[SUMMARY OF EARLIER CONVERSATION]\n")
+}
+
+// SystemMessage returns the system message; nil if there is none.
+func (c *Conversation) SystemMessage() *azopenai.ChatMessage { return c.system }
+
+// SummaryMessage returns the message holding the summary; nil if there is no summary.
+func (c *Conversation) SummaryMessage() *azopenai.ChatMessage { return c.summary }
+
+// History returns the user & assistant messages, oldest first.
+func (c *Conversation) History() []azopenai.ChatMessage { return c.conversation }
+
+// Messages returns all the messages in the order they're sent to the model.
+func (c *Conversation) Messages() []azopenai.ChatMessage {
+	msgs := []azopenai.ChatMessage{}
+	if c.system != nil {
+		msgs = append(msgs, *c.system)
+	}
+	if c.summary != nil {
+		msgs = append(msgs, *c.summary)
+	}
+	msgs = append(msgs, c.conversation...)
+	return msgs
+}
+
+// Turn is a chat message in a form templates can render.
+type Turn struct{ Role, Content string }
+
+// Turns returns the user & assistant messages as Turns, oldest first.
+func (c *Conversation) Turns() []Turn {
+	turns := make([]Turn, len(c.conversation))
+	for i, m := range c.conversation {
+		turns[i] = Turn{Role: string(*m.Role), Content: *m.Content}
+	}
+	return turns
+}
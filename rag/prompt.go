@@ -0,0 +1,140 @@
+package rag
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/cognitiveservices/azopenai"
+	"github.com/pkoukk/tiktoken-go"
+	"golang.org/x/exp/slices"
+
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+// ErrContextLengthExceeded is returned when messages don't fit in a chat model's context length.
+var ErrContextLengthExceeded = errors.New("the messages exceed the model's context length")
+
+// PromptBuilder assembles the messages sent to the chat model so that they always fit in the
+// model's context window minus the tokens reserved for the answer. Rather than waiting for the
+// service to reject an over-length request, it counts tokens up front & trims the prompt.
+type PromptBuilder struct {
+	encoding      *tiktoken.Tiktoken // nil if the encoding couldn't be loaded; tokens are estimated instead
+	contextWindow int                // Total tokens the model accepts (prompt + answer)
+	maxTokens     int                // Tokens reserved for the answer
+}
+
+// NewPromptBuilder returns a PromptBuilder counting tokens the way model does; maxTokens of the
+// contextWindow are reserved for the answer. tiktoken downloads its encodings the first time
+// they're used (caching them in TIKTOKEN_CACHE_DIR) so, if the encoding can't be loaded (offline
+// with a local model, say), the PromptBuilder estimates tokens from the text's length instead;
+// Estimated reports whether it does.
+func NewPromptBuilder(model string, contextWindow, maxTokens int) *PromptBuilder {
+	encoding, err := tiktoken.EncodingForModel(model)
+	if err != nil { // Azure deployment names & local models are unknown to tiktoken; GPT-3.5/4 use cl100k_base
+		if encoding, err = tiktoken.GetEncoding("cl100k_base"); err != nil {
+			encoding = nil
+		}
+	}
+	return &PromptBuilder{encoding: encoding, contextWindow: contextWindow, maxTokens: maxTokens}
+}
+
+// Estimated returns true if the PromptBuilder estimates tokens because the encoding couldn't be loaded.
+func (pb *PromptBuilder) Estimated() bool { return pb.encoding == nil }
+
+// Tokens returns the number of tokens in s.
+func (pb *PromptBuilder) Tokens(s string) int {
+	if pb.encoding == nil {
+		// English averages ~4 bytes per token; assuming 3 overestimates so prompts still fit
+		return (len(s) + 2) / 3
+	}
+	return len(pb.encoding.Encode(s, nil, nil))
+}
+
+// MessageTokens returns the number of prompt tokens msgs consume including the per-message overhead.
+// https://github.com/openai/openai-cookbook/blob/main/examples/How_to_count_tokens_with_tiktoken.ipynb
+func (pb *PromptBuilder) MessageTokens(msgs ...azopenai.ChatMessage) int {
+	const tokensPerMessage = 3 // Every message is wrapped in <|start|>{role}\n{content}<|end|>\n
+	tokens := 0
+	for _, m := range msgs {
+		tokens += tokensPerMessage + pb.Tokens(string(*m.Role))
+		if m.Content != nil {
+			tokens += pb.Tokens(*m.Content)
+		}
+	}
+	return tokens
+}
+
+// PromptBreakdown reports how the context window was spent by the most recently built prompt.
+type PromptBreakdown struct {
+	System, History, UserMsg int // Tokens used by each part of the prompt; UserMsg includes the groundings & question
+	Groundings               int // Tokens used by the groundings alone
+	Reserved                 int // Tokens reserved for the answer
+	ContextWindow            int
+	DroppedGroundings        int // Lowest-scored groundings trimmed to fit
+	DroppedTurns             int // Oldest user/assistant turns left out of the prompt to fit
+}
+
+// Total returns the tokens the prompt & the reserved answer need from the context window.
+func (b PromptBreakdown) Total() int { return b.System + b.History + b.UserMsg + b.Reserved + 3 } // 3 primes the reply
+
+// String summarizes the breakdown on one line, as the /tokens chat command shows it.
+func (b PromptBreakdown) String() string {
+	return fmt.Sprintf("system=%d history=%d user=%d (groundings=%d) reserved=%d total=%d/%d; dropped %d groundings & %d turns",
+		b.System, b.History, b.UserMsg, b.Groundings, b.Reserved, b.Total(), b.ContextWindow, b.DroppedGroundings, b.DroppedTurns)
+}
+
+// Prompt is the result of PromptBuilder.Build.
+type Prompt struct {
+	Messages   []azopenai.ChatMessage  // The messages to send to the chat model
+	Groundings []vectordb.SearchResult // The groundings that fit in the prompt
+	Breakdown  PromptBreakdown
+}
+
+// Build returns cm's messages followed by a user message rendered from groundings, trimming
+// the prompt until it fits: first the lowest-scored groundings (groundings are sorted best first)
+// are left out, then the oldest user/assistant turns. Build never changes cm; what the
+// conversation remembers is up to its ConversationMemory, so turns left out of this prompt can
+// still be summarized. Build returns ErrContextLengthExceeded if the system message, any summary
+// & a user message without any groundings still don't fit, & renderUserMsg's error if it returns one.
+func (pb *PromptBuilder) Build(cm *Conversation, groundings []vectordb.SearchResult, renderUserMsg func(groundings []vectordb.SearchResult) (string, error)) (Prompt, error) {
+	b := PromptBreakdown{Reserved: pb.maxTokens, ContextWindow: pb.contextWindow}
+	userMsg := func(groundings []vectordb.SearchResult) (azopenai.ChatMessage, error) {
+		content, err := renderUserMsg(groundings)
+		return azopenai.ChatMessage{Role: to.Ptr(azopenai.ChatRoleUser), Content: &content}, err
+	}
+	if cm.system != nil {
+		b.System = pb.MessageTokens(*cm.system)
+	}
+	emptyMsg, err := userMsg(nil)
+	if err != nil {
+		return Prompt{Breakdown: b}, err
+	}
+	msgs := cm.Messages()
+	history := len(msgs) - len(cm.conversation) // Index of the oldest turn in msgs
+	for {
+		b.History = pb.MessageTokens(msgs...) - b.System // Includes the summary of earlier turns
+		msg, err := userMsg(groundings)
+		if err != nil {
+			return Prompt{Breakdown: b}, err
+		}
+		b.UserMsg = pb.MessageTokens(msg)
+		b.Groundings = b.UserMsg - pb.MessageTokens(emptyMsg)
+		switch {
+		case b.Total() <= pb.contextWindow:
+			return Prompt{Messages: append(msgs, msg), Groundings: groundings, Breakdown: b}, nil
+		case len(groundings) > 0:
+			groundings = groundings[:len(groundings)-1]
+			b.DroppedGroundings++
+		case len(msgs) > history:
+			number := len(msgs) - history
+			if number > 2 {
+				number = 2
+			}
+			msgs = slices.Delete(msgs, history, history+number) // msgs is Messages' copy so cm is unchanged
+			b.DroppedTurns++
+		default:
+			return Prompt{Breakdown: b}, fmt.Errorf("%w: the prompt needs %d tokens but only %d are available", ErrContextLengthExceeded, b.Total(), pb.contextWindow)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package rag
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+// newTestPromptBuilder returns a PromptBuilder estimating tokens so tests don't download the encoding.
+func newTestPromptBuilder(contextWindow int) *PromptBuilder {
+	return &PromptBuilder{contextWindow: contextWindow, maxTokens: 100}
+}
+
+func TestBuildTrimsGroundingsThenTurns(t *testing.T) {
+	turns := []string{"first question", "a long first answer " + strings.Repeat("word ", 50), "second question", "second answer"}
+	conversation := func(keepTurns int) *Conversation {
+		cm := NewConversation("You answer questions.")
+		for i := len(turns) - 2*keepTurns; i < len(turns); i += 2 {
+			cm.AddUserContent(turns[i])
+			cm.AddAssistantContent(turns[i+1])
+		}
+		return cm
+	}
+	groundings := []vectordb.SearchResult{}
+	for _, id := range []string{"best grounding", "good grounding", "worst grounding"} {
+		groundings = append(groundings, vectordb.SearchResult{Entry: &vectordb.Entry{ID: vectordb.ID(id + " " + strings.Repeat("text ", 20))}})
+	}
+	userMsg := func(groundings []vectordb.SearchResult) string {
+		sb := &strings.Builder{}
+		for _, g := range groundings {
+			sb.WriteString(string(g.Entry.ID) + "\n")
+		}
+		return sb.String() + "What is it?"
+	}
+	render := func(groundings []vectordb.SearchResult) (string, error) { return userMsg(groundings), nil }
+	// tokens returns the tokens needed by a prompt with the most recent keepTurns turns & the best keepGroundings groundings
+	tokens := func(keepTurns, keepGroundings int) int {
+		p, err := newTestPromptBuilder(1<<20).Build(conversation(keepTurns), groundings[:keepGroundings], render)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Breakdown.Total()
+	}
+
+	for _, tc := range []struct {
+		name                                    string
+		contextWindow                           int
+		wantTurns, wantGroundings               int // Left in the prompt
+		wantDroppedTurns, wantDroppedGroundings int
+		wantErr                                 error
+	}{
+		{"fits", tokens(2, 3), 2, 3, 0, 0, nil},
+		{"worst grounding dropped first", tokens(2, 2), 2, 2, 0, 1, nil},
+		{"every grounding dropped before any turn", tokens(2, 0), 2, 0, 0, 3, nil},
+		{"oldest turn dropped", tokens(1, 0), 1, 0, 1, 3, nil},
+		{"every turn dropped", tokens(0, 0), 0, 0, 2, 3, nil},
+		{"question doesn't fit", tokens(0, 0) - 1, 0, 0, 2, 3, ErrContextLengthExceeded},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cm := conversation(2)
+			p, err := newTestPromptBuilder(tc.contextWindow).Build(cm, groundings, render)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Build returned %v; want %v", err, tc.wantErr)
+			}
+			if len(cm.History()) != len(turns) { // Turns left out of the prompt are the memory's to forget or summarize
+				t.Fatalf("Build changed the conversation's history to %d messages; want %d", len(cm.History()), len(turns))
+			}
+			if p.Breakdown.DroppedTurns != tc.wantDroppedTurns || p.Breakdown.DroppedGroundings != tc.wantDroppedGroundings {
+				t.Fatalf("dropped %d turns & %d groundings; want %d & %d", p.Breakdown.DroppedTurns, p.Breakdown.DroppedGroundings, tc.wantDroppedTurns, tc.wantDroppedGroundings)
+			}
+			if err != nil {
+				return
+			}
+			if p.Breakdown.Total() > tc.contextWindow {
+				t.Fatalf("the prompt needs %d tokens but the context window is %d", p.Breakdown.Total(), tc.contextWindow)
+			}
+			if history := p.Messages[1 : len(p.Messages)-1]; len(history) != 2*tc.wantTurns ||
+				(tc.wantTurns > 0 && *history[len(history)-1].Content != turns[len(turns)-1]) {
+				t.Fatalf("the prompt has %d history messages; want the last %d", len(history), 2*tc.wantTurns)
+			}
+			if len(p.Groundings) != tc.wantGroundings {
+				t.Fatalf("the prompt has %d groundings; want %d", len(p.Groundings), tc.wantGroundings)
+			}
+			for i, g := range p.Groundings {
+				if g.Entry != groundings[i].Entry {
+					t.Fatalf("grounding %d is %q; want the best groundings in order", i, g.Entry.ID)
+				}
+			}
+			if got := p.Messages[len(p.Messages)-1]; *got.Content != userMsg(groundings[:tc.wantGroundings]) {
+				t.Fatalf("the last message is %q; want the rendered user message", *got.Content)
+			}
+		})
+	}
+}
+
+func TestBuildReturnsRenderError(t *testing.T) {
+	errRender := errors.New("the template failed")
+	groundings := []vectordb.SearchResult{{Entry: &vectordb.Entry{ID: "grounding"}}}
+	render := func(groundings []vectordb.SearchResult) (string, error) {
+		if len(groundings) > 0 {
+			return "", errRender // As a template indexing past the groundings that fit does
+		}
+		return "What is it?", nil
+	}
+	if _, err := newTestPromptBuilder(1<<20).Build(NewConversation("System"), groundings, render); !errors.Is(err, errRender) {
+		t.Fatalf("Build returned %v; want %v", err, errRender)
+	}
+}
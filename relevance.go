@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"time"
+
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+type relevanceParams struct {
+	minScore      float64
+	notCoveredMsg string
+	gapLog        string
+}
+
+// addRelevanceFlags adds the flags that decide when retrieval is too weak to answer to cmd.
+func addRelevanceFlags(cmd *flag.FlagSet, p *relevanceParams) {
+	cmd.Float64Var(&p.minScore, "minscore", 0, "minimum similarity score of a grounding; if no grounding scores this high, the question isn't sent to the chat model (0 disables; ~0.78 suits text-embedding-ada-002)")
+	cmd.StringVar(&p.notCoveredMsg, "notcoveredmsg", "I'm sorry, but the {{.Topic}} document doesn't appear to cover that. Try rephrasing your question or asking about something else in the document.",
+		"template of the reply given when no grounding reaches -minscore (uses the fields of promptData); @pathname reads it from a file")
+	cmd.StringVar(&p.gapLog, "gaplog", "", "JSON Lines file recording questions no grounding reached -minscore for, for corpus-gap analysis; defaults to <db>.gaps.jsonl")
+}
+
+// relevantGroundings returns the groundings scoring at least minScore in their original order.
+func relevantGroundings(groundings []vectordb.SearchResult, minScore float64) []vectordb.SearchResult {
+	relevant := []vectordb.SearchResult{}
+	for _, g := range groundings {
+		if float64(g.Score) >= minScore {
+			relevant = append(relevant, g)
+		}
+	}
+	return relevant
+}
+
+// gapEvent records a question the corpus couldn't answer.
+type gapEvent struct {
+	Time        time.Time `json:"time"`
+	DB          string    `json:"db"`
+	Session     string    `json:"session"`
+	Question    string    `json:"question"`
+	SearchQuery string    `json:"searchQuery"`
+	BestScore   float32   `json:"bestScore"` // Score of the best grounding found; 0 if the DB returned none
+	MinScore    float64   `json:"minScore"`
+}
+
+// logGap appends e to the JSON Lines file at pathname.
+func logGap(pathname string, e gapEvent) error {
+	f, err := os.OpenFile(pathname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(e); err != nil { // Encode writes a single line per event
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/cognitiveservices/azopenai"
+	"golang.org/x/exp/slices"
+
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+// Reranker re-scores retrieved texts for relevance to a query. Cosine similarity between
+// embeddings is a cheap but rough proxy for relevance so chat retrieves many candidates from the
+// VectorDB & keeps the ones the Reranker scores best.
+type Reranker interface {
+	// Score returns the relevance of each text to query in the same order as texts; bigger is more relevant.
+	Score(ctx context.Context, query string, texts []string) ([]float32, error)
+
+	// Model identifies what is scoring the texts.
+	Model() string
+}
+
+var _, _, _, _ Reranker = (*pointwiseReranker)(nil), (*listwiseReranker)(nil), (*crossEncoderReranker)(nil), (*fakeReranker)(nil)
+
+type rerankParams struct {
+	mode       string // "off", "pointwise", "listwise", "crossencoder" or "fake"
+	url        string // Cross-encoder endpoint
+	apiKey     string // Cross-encoder API key; the chat & embedding services' key is never sent to it
+	model      string // Cross-encoder model
+	candidates int    // Number of VectorDB results to re-rank
+}
+
+// addRerankFlags adds the flags that select & configure the Reranker to cmd.
+func addRerankFlags(cmd *flag.FlagSet, p *rerankParams) {
+	cmd.StringVar(&p.mode, "rerank", "off", "re-rank retrieved chunks: off, pointwise (the chat model rates each chunk), listwise (the chat model orders all chunks), crossencoder or fake")
+	cmd.StringVar(&p.url, "rerankurl", "", "URL of the cross-encoder's rerank endpoint (Cohere/Jina-compatible, e.g. http://localhost:8080/v1/rerank)")
+	cmd.StringVar(&p.apiKey, "rerankapikey", "", "API key sent as a bearer token to -rerankurl; none is sent if empty")
+	cmd.StringVar(&p.model, "rerankmodel", "", "cross-encoder model sent to the rerank endpoint")
+	cmd.IntVar(&p.candidates, "rerankcandidates", 50, "number of chunks retrieved from the DB for re-ranking; the best -k are kept")
+}
+
+// newReranker creates the Reranker selected by p; it returns nil if re-ranking is off & an error
+// wrapping errUsage if p is invalid.
+func newReranker(p rerankParams, model ChatModel) (Reranker, error) {
+	switch p.mode {
+	case "off":
+		return nil, nil
+	case "pointwise":
+		return newCachingReranker(&pointwiseReranker{model: model}), nil
+	case "listwise":
+		// Not cached: a listwise score is a position among the other candidates, not a property of one text
+		return &listwiseReranker{model: model}, nil
+	case "crossencoder":
+		if p.url == "" {
+			return nil, usageError("-rerank=crossencoder requires -rerankurl")
+		}
+		return newCachingReranker(&crossEncoderReranker{url: p.url, model: p.model, apiKey: p.apiKey}), nil
+	case "fake":
+		return &fakeReranker{}, nil
+	default:
+		return nil, usageError("unknown re-ranking mode %q; expected off, pointwise, listwise, crossencoder or fake", p.mode)
+	}
+}
+
+// rerank returns the k candidates r scores as most relevant to query, best first.
+func rerank(ctx context.Context, r Reranker, query string, candidates []vectordb.SearchResult, k int) ([]vectordb.SearchResult, error) {
+	texts := make([]string, len(candidates))
+	for i, c := range candidates {
+		texts[i] = string(c.Entry.ID)
+	}
+	scores, err := r.Score(ctx, query, texts)
+	if err != nil {
+		return nil, err
+	}
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) bool { return scores[a] > scores[b] }) // Ties keep their vector order
+	if len(order) > k {
+		order = order[:k]
+	}
+	reranked := make([]vectordb.SearchResult, len(order))
+	for i, o := range order {
+		reranked[i] = candidates[o] // Score stays the vector similarity so -minscore means the same thing
+	}
+	return reranked, nil
+}
+
+// cachingReranker remembers the scores of recent query/text pairs; chat often re-ranks the same
+// chunks for a conversation's questions. Under serve every distinct question adds scores so the
+// least-recently used are evicted once the cache holds maxScores.
+type cachingReranker struct {
+	Reranker
+	maxScores int
+	mu        sync.Mutex
+	scores    map[[sha256.Size]byte]*list.Element // Values are *cachedScore
+	lru       *list.List                          // Most-recently used first
+}
+
+// cachedScore is a cachingReranker's score for the query/text pair whose hash is key.
+type cachedScore struct {
+	key   [sha256.Size]byte
+	score float32
+}
+
+func newCachingReranker(r Reranker) Reranker {
+	const maxScores = 100_000 // ~15MB
+	return &cachingReranker{Reranker: r, maxScores: maxScores, scores: map[[sha256.Size]byte]*list.Element{}, lru: list.New()}
+}
+
+// key hashes the model, query & text so a cached score doesn't keep a copy of the chunk's text.
+func (r *cachingReranker) key(query, text string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(r.Model() + "\x00" + query + "\x00" + text))
+}
+
+func (r *cachingReranker) Score(ctx context.Context, query string, texts []string) ([]float32, error) {
+	scores, misses, missTexts := make([]float32, len(texts)), []int{}, []string{}
+	r.mu.Lock()
+	for i, text := range texts {
+		if e, ok := r.scores[r.key(query, text)]; ok {
+			scores[i] = e.Value.(*cachedScore).score
+			r.lru.MoveToFront(e)
+		} else {
+			misses, missTexts = append(misses, i), append(missTexts, text)
+		}
+	}
+	r.mu.Unlock()
+	if len(misses) == 0 {
+		return scores, nil
+	}
+
+	missScores, err := r.Reranker.Score(ctx, query, missTexts)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, s := range missScores {
+		scores[misses[i]] = s
+		key := r.key(query, missTexts[i])
+		if e, ok := r.scores[key]; ok { // A concurrent Score cached it first
+			e.Value.(*cachedScore).score = s
+			r.lru.MoveToFront(e)
+			continue
+		}
+		r.scores[key] = r.lru.PushFront(&cachedScore{key: key, score: s})
+		if r.lru.Len() > r.maxScores {
+			delete(r.scores, r.lru.Remove(r.lru.Back()).(*cachedScore).key)
+		}
+	}
+	return scores, nil
+}
+
+const pointwiseMsg = `
+Rate how useful the [PASSAGE] is for answering the [QUESTION] on a scale from 0 (irrelevant) to 10 (answers it completely).
+Respond with only the number.
+
+[PASSAGE]
+{{.Text}}
+
+[QUESTION]
+{{.Query}}`
+
+var (
+	pointwiseMsgTmpl = template.Must(template.New("pointwiseMsg").Parse(pointwiseMsg))
+	numberRegexp     = regexp.MustCompile(`\d+(?:\.\d+)?`)
+)
+
+// pointwiseReranker asks the chat model to rate each text on its own.
+type pointwiseReranker struct {
+	model ChatModel
+}
+
+const pointwiseConcurrency = 8 // Rating 50 chunks one at a time would take far too long
+
+// Score rates each text; a text whose rating can't be parsed scores 0 rather than failing the
+// whole re-ranking.
+func (r *pointwiseReranker) Score(ctx context.Context, query string, texts []string) ([]float32, error) {
+	scores, errs := make([]float32, len(texts)), make([]error, len(texts))
+	sem, wg := make(chan struct{}, pointwiseConcurrency), sync.WaitGroup{}
+	for i, text := range texts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+		wg.Add(1)
+		go func(i int, text string) {
+			defer func() { <-sem; wg.Done() }()
+			ratePrompt, err := templateToString(pointwiseMsgTmpl, struct{ Text, Query string }{text, query})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			rating, err := complete(ctx, r.model, []azopenai.ChatMessage{{Role: to.Ptr(azopenai.ChatRoleUser), Content: &ratePrompt}},
+				chatOptions{MaxTokens: 4, Temperature: 0.0})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if s, err := strconv.ParseFloat(numberRegexp.FindString(rating), 32); err == nil {
+				scores[i] = float32(s)
+			}
+		}(i, text)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scores, nil
+}
+
+func (r *pointwiseReranker) Model() string { return "pointwise:" + r.model.Model() }
+
+const listwiseMsg = `
+Order the numbered [PASSAGE]s by how useful they are for answering the [QUESTION], most useful first.
+Respond with only a JSON array of passage numbers, for example [3,1,2]. Omit irrelevant passages.
+
+[PASSAGE]
+{{range $i, $text := .Texts}}[{{inc $i}}] {{$text}}
+
+{{end}}
+[QUESTION]
+{{.Query}}`
+
+var listwiseMsgTmpl = template.Must(template.New("listwiseMsg").
+	Funcs(template.FuncMap{"inc": func(i int) int { return i + 1 }}).Parse(listwiseMsg))
+
+// listwiseReranker asks the chat model to order all the texts in a single prompt.
+type listwiseReranker struct {
+	model ChatModel
+}
+
+func (r *listwiseReranker) Score(ctx context.Context, query string, texts []string) ([]float32, error) {
+	orderPrompt, err := templateToString(listwiseMsgTmpl, struct {
+		Texts []string
+		Query string
+	}{texts, query})
+	if err != nil {
+		return nil, err
+	}
+	ordering, err := complete(ctx, r.model, []azopenai.ChatMessage{{Role: to.Ptr(azopenai.ChatRoleUser), Content: &orderPrompt}},
+		chatOptions{MaxTokens: int32(16 + 4*len(texts)), Temperature: 0.0})
+	if err != nil {
+		return nil, err
+	}
+	ordering = jsonArray(ordering)
+	order := []int{}
+	if err := json.Unmarshal([]byte(ordering), &order); err != nil {
+		return nil, fmt.Errorf("the re-ranker returned an unexpected ordering: %q", ordering)
+	}
+	scores := make([]float32, len(texts)) // Omitted texts score 0, below every ranked text
+	for pos, n := range order {
+		if n >= 1 && n <= len(texts) && scores[n-1] == 0 {
+			scores[n-1] = float32(len(order) - pos)
+		}
+	}
+	return scores, nil
+}
+
+func (r *listwiseReranker) Model() string { return "listwise:" + r.model.Model() }
+
+// crossEncoderReranker scores texts with a cross-encoder served by an HTTP endpoint implementing
+// the Cohere/Jina rerank API (text-embeddings-inference, Infinity, vLLM, llama.cpp, etc.).
+type crossEncoderReranker struct {
+	url    string
+	model  string
+	apiKey string
+}
+
+func (r *crossEncoderReranker) Score(ctx context.Context, query string, texts []string) ([]float32, error) {
+	body, err := json.Marshal(struct {
+		Model     string   `json:"model,omitempty"`
+		Query     string   `json:"query"`
+		Documents []string `json:"documents"`
+	}{r.model, query, texts})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+r.apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, normalizeServiceError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("re-ranking service returned %s", resp.Status)
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+			err = fmt.Errorf("%w: %w", ErrAuth, err)
+		case resp.StatusCode == http.StatusTooManyRequests:
+			err = fmt.Errorf("%w: %w", ErrRateLimited, err)
+		case resp.StatusCode >= http.StatusInternalServerError:
+			err = fmt.Errorf("%w: %w", ErrServiceUnavailable, err)
+		}
+		return nil, err
+	}
+
+	result := struct {
+		Results []struct {
+			Index          int     `json:"index"`
+			RelevanceScore float32 `json:"relevance_score"`
+		} `json:"results"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Results) != len(texts) {
+		return nil, fmt.Errorf("re-ranking service returned %d scores for %d texts", len(result.Results), len(texts))
+	}
+	scores := make([]float32, len(texts))
+	for _, res := range result.Results {
+		if res.Index < 0 || res.Index >= len(texts) {
+			return nil, fmt.Errorf("re-ranking service returned an unexpected index")
+		}
+		scores[res.Index] = res.RelevanceScore
+	}
+	return scores, nil
+}
+
+func (r *crossEncoderReranker) Model() string { return "crossencoder:" + r.model }
+
+// fakeReranker is an in-process Reranker for tests & offline experiments. It scores a text by the
+// fraction of the query's words it contains.
+type fakeReranker struct{}
+
+func (r *fakeReranker) Score(ctx context.Context, query string, texts []string) ([]float32, error) {
+	words := func(s string) []string {
+		return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	}
+	queryWords := words(query)
+	scores := make([]float32, len(texts))
+	for i, text := range texts {
+		textWords := words(text)
+		for _, w := range queryWords {
+			if slices.Contains(textWords, w) {
+				scores[i]++
+			}
+		}
+		if len(queryWords) > 0 {
+			scores[i] /= float32(len(queryWords))
+		}
+	}
+	return scores, nil
+}
+
+func (r *fakeReranker) Model() string { return "fake" }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/exp/slices"
+
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+func TestRetrieveAndRerank(t *testing.T) {
+	ctx := context.Background()
+	texts := []string{
+		"The hull is made of fibreglass reinforced with carbon fibre",
+		"The mast is aluminium and was replaced in 2019",
+		"The engine is a diesel inboard serviced every year",
+		"Hull osmosis was treated and the hull was re-gelcoated",
+	}
+	embedder := &fakeEmbedder{dimensions: 64}
+	vectors, err := embedder.Embed(ctx, texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make([]*vectordb.Entry, len(texts))
+	for i, text := range texts {
+		entries[i] = &vectordb.Entry{ID: vectordb.ID(text), Vector: vectors[i]}
+	}
+	slices.SortFunc(entries, func(a, b *vectordb.Entry) bool { return a.ID < b.ID })
+	db := vectordb.New(vectordb.CosineSimilarity{}, entries)
+
+	for _, tc := range []struct {
+		query string
+		k     int
+		want  []string // Best first
+	}{
+		{"what is the hull made of", 1, []string{texts[0]}},
+		{"hull osmosis", 2, []string{texts[3], texts[0]}},
+		{"when was the mast replaced", 1, []string{texts[1]}},
+		{"is the diesel engine serviced", 1, []string{texts[2]}},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			queryVectors, err := embedder.Embed(ctx, []string{tc.query})
+			if err != nil {
+				t.Fatal(err)
+			}
+			candidates, err := db.Query(queryVectors[0], len(texts), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reranked, err := rerank(ctx, newCachingReranker(&fakeReranker{}), tc.query, candidates, tc.k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, r := range reranked {
+				got = append(got, string(r.Entry.ID))
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFakeEmbedderIsDeterministic(t *testing.T) {
+	e := &fakeEmbedder{dimensions: 16}
+	a, err := e.Embed(context.Background(), []string{"Same words", "same WORDS!", "different text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(a[0], a[1]) {
+		t.Fatalf("texts differing only in case & punctuation have different vectors: %v & %v", a[0], a[1])
+	}
+	if slices.Equal(a[0], a[2]) {
+		t.Fatalf("different texts have the same vector: %v", a[0])
+	}
+}
+
+// countingReranker counts the texts it's asked to score.
+type countingReranker struct {
+	fakeReranker
+	scored []string
+}
+
+func (r *countingReranker) Score(ctx context.Context, query string, texts []string) ([]float32, error) {
+	r.scored = append(r.scored, texts...)
+	return r.fakeReranker.Score(ctx, query, texts)
+}
+
+func TestCachingRerankerEvictsLeastRecentlyUsed(t *testing.T) {
+	counter := &countingReranker{}
+	r := newCachingReranker(counter).(*cachingReranker)
+	r.maxScores = 2
+	for _, tc := range []struct {
+		texts      []string
+		wantScored []string // Cache misses
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}},
+		{[]string{"a"}, nil},           // Makes b the least-recently used
+		{[]string{"c"}, []string{"c"}}, // Evicts b
+		{[]string{"a", "b"}, []string{"b"}},
+	} {
+		counter.scored = nil
+		if _, err := r.Score(context.Background(), "query", tc.texts); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(counter.scored, tc.wantScored) {
+			t.Fatalf("scoring %q scored %q; want %q", tc.texts, counter.scored, tc.wantScored)
+		}
+		if r.lru.Len() > r.maxScores || len(r.scores) != r.lru.Len() {
+			t.Fatalf("the cache holds %d scores in its LRU list & %d in its map; want at most %d", r.lru.Len(), len(r.scores), r.maxScores)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+	"text/template"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/cognitiveservices/azopenai"
+	"golang.org/x/exp/slices"
+
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+type retrievalParams struct {
+	mode    string // "single", "multiquery" or "hyde"
+	queries int    // Number of paraphrases generated by multiquery
+}
+
+// addRetrievalFlags adds the flags that select how the search query is expanded before retrieval to cmd.
+func addRetrievalFlags(cmd *flag.FlagSet, p *retrievalParams) {
+	cmd.StringVar(&p.mode, "retrieval", "single", "retrieval mode: single (embed the question), multiquery (also embed paraphrases of it) or hyde (also embed a hypothetical answer); a resumed session keeps its mode unless this is set")
+	cmd.IntVar(&p.queries, "retrievalqueries", 3, "number of paraphrases generated by -retrieval=multiquery")
+}
+
+// validateRetrievalMode returns an error wrapping errUsage if mode isn't a retrieval mode.
+func validateRetrievalMode(mode string) error {
+	if mode != "single" && mode != "multiquery" && mode != "hyde" {
+		return usageError("unknown retrieval mode %q; expected single, multiquery or hyde", mode)
+	}
+	return nil
+}
+
+const multiQueryMsg = `
+Write {{.N}} different versions of the [QUESTION] to search a {{.Topic}} document with. Use different wording and synonyms, and
+spell out abbreviations, but keep the meaning. Respond with only the questions, one per line, without numbering.
+
+[QUESTION]
+{{.Question}}`
+
+// hydeMsg asks for a Hypothetical Document Embedding: a passage that looks like the document's
+// text embeds closer to the right chunks than a short question does, even if its facts are wrong.
+const hydeMsg = `
+Write a short passage from a {{.Topic}} document that answers the [QUESTION]. Write it in the style of a technical manual.
+If you don't know the answer, write a plausible one. Respond with only the passage.
+
+[QUESTION]
+{{.Question}}`
+
+var (
+	multiQueryMsgTmpl = template.Must(template.New("multiQueryMsg").Parse(multiQueryMsg))
+	hydeMsgTmpl       = template.Must(template.New("hydeMsg").Parse(hydeMsg))
+)
+
+// expandQuery returns the texts to embed & search for query; the first is always query itself.
+func expandQuery(ctx context.Context, p retrievalParams, model ChatModel, topic, query string) ([]string, error) {
+	data := struct {
+		N               int
+		Topic, Question string
+	}{p.queries, topic, query}
+	switch p.mode {
+	case "multiquery":
+		expandPrompt, err := templateToString(multiQueryMsgTmpl, data)
+		if err != nil {
+			return nil, err
+		}
+		paraphrases, err := complete(ctx, model, []azopenai.ChatMessage{{Role: to.Ptr(azopenai.ChatRoleUser), Content: &expandPrompt}},
+			chatOptions{MaxTokens: int32(64 * p.queries), Temperature: 0.7})
+		if err != nil {
+			return nil, err
+		}
+		queries := []string{query}
+		for _, line := range strings.Split(paraphrases, "\n") {
+			if line = strings.TrimSpace(bulletRegexp.ReplaceAllString(line, "")); line != "" && !slices.Contains(queries, line) {
+				queries = append(queries, line)
+			}
+		}
+		return queries, nil
+
+	case "hyde":
+		hydePrompt, err := templateToString(hydeMsgTmpl, data)
+		if err != nil {
+			return nil, err
+		}
+		passage, err := complete(ctx, model, []azopenai.ChatMessage{{Role: to.Ptr(azopenai.ChatRoleUser), Content: &hydePrompt}},
+			chatOptions{MaxTokens: 256, Temperature: 0.0})
+		if err != nil {
+			return nil, err
+		}
+		return []string{query, strings.TrimSpace(passage)}, nil
+
+	default:
+		return []string{query}, nil
+	}
+}
+
+const rrfK = 60 // The constant from the reciprocal rank fusion paper; it damps the influence of the top ranks
+
+// fuseResults merges result lists using reciprocal rank fusion & returns the best topK, best first.
+// Each result keeps its best similarity score so -minscore means the same thing in every mode.
+func fuseResults(lists [][]vectordb.SearchResult, topK int) []vectordb.SearchResult {
+	if len(lists) == 1 {
+		return lists[0] // Nothing to fuse
+	}
+	fused, rrf := []vectordb.SearchResult{}, map[vectordb.ID]float64{}
+	for _, list := range lists {
+		for rank, r := range list {
+			i := slices.IndexFunc(fused, func(f vectordb.SearchResult) bool { return f.Entry.ID == r.Entry.ID })
+			if i < 0 {
+				fused = append(fused, r)
+			} else if r.Score > fused[i].Score {
+				fused[i].Score = r.Score
+			}
+			rrf[r.Entry.ID] += 1 / float64(rrfK+rank+1)
+		}
+	}
+	slices.SortStableFunc(fused, func(a, b vectordb.SearchResult) bool { return rrf[a.Entry.ID] > rrf[b.Entry.ID] })
+	if len(fused) > topK {
+		fused = fused[:topK]
+	}
+	return fused
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+type serveCmdParams struct {
+	ragParams
+	addr            string
+	shutdownTimeout time.Duration
+	collectionsDir  string
+	maxK            int
+}
+
+func newServeCmd(params *serveCmdParams) *flag.FlagSet {
+	cmd := flag.NewFlagSet("serve", flag.ExitOnError)
+	addRAGFlags(cmd, &params.ragParams)
+	cmd.StringVar(&params.addr, "addr", "localhost:8080", "address the HTTP server listens on; the endpoints are unauthenticated so only listen on other interfaces (e.g. :8080) behind an authenticating proxy")
+	cmd.DurationVar(&params.shutdownTimeout, "shutdowntimeout", 30*time.Second, "time in-flight requests are given to finish when the server is stopped")
+	cmd.StringVar(&params.collectionsDir, "collections", "", "directory of the vector DB collections managed under /collections; empty disables the collections API")
+	cmd.IntVar(&params.maxK, "maxk", 100, "maximum number of results (k) a request may ask for; larger requests are rejected")
+	return cmd
+}
+
+// ragServer serves the ragPipeline over HTTP:
+//
+//	POST /query       {"query": "...", "k": 5, "filter": {"source": "BoatSurvey.pdf", "pages": "3-10", "text": "hull"}}
+//	POST /ask         {"question": "...", "k": 5, "filter": {...}, "history": [{"role": "user", "content": "..."}, ...]}
+//	POST /ask/stream  Like /ask but answers with Server-Sent Events: "search", "delta"s & finally "done" or "error"
+//	GET  /healthz     200 while the process is running
+//	GET  /readyz      200 once the DB is loaded; 503 while loading & shutting down
+//
+// It also serves a subset of the OpenAI API so OpenAI clients get grounded answers; see handleOpenAI.
+// With -collections, it's also a vector store managing collections of entries; see handleCollections.
+// Without -db, only the collections API & /v1/embeddings are served.
+type ragServer struct {
+	rag         atomic.Pointer[ragPipeline] // nil until the DB is loaded
+	noRAG       bool                        // There's no -db to answer from
+	maxK        int                         // Requests asking for more results are rejected
+	collections *collectionStore
+	embedder    Embedder // Embeds the text sent to the collections API
+	stopping    atomic.Bool
+}
+
+func serve(arguments []string) error {
+	params := &serveCmdParams{}
+	if err := parseCmdLine(newServeCmd(params), arguments); err != nil {
+		return err
+	}
+	if params.dbPathname == "" && params.collectionsDir == "" {
+		return usageError("serve requires -db <vector DB> and/or -collections <directory>")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := &ragServer{noRAG: params.dbPathname == "", maxK: params.maxK}
+	if params.collectionsDir != "" {
+		cred, err := newServiceCredential(params.auth)
+		if err != nil {
+			return err
+		}
+		embedder, err := newEmbedder(params.embedder, params.clientUrl, cred)
+		if err != nil {
+			return err
+		}
+		collections, err := openCollectionStore(params.collectionsDir)
+		if err != nil {
+			return fmt.Errorf("opening the collections in %s: %w", params.collectionsDir, err)
+		}
+		s.collections = collections
+		s.embedder = newCachingEmbedder(embedder, newEmbeddingCache(params.cacheDir, params.cacheMaxMB<<20))
+		defer func() {
+			if err := s.collections.Close(); err != nil {
+				log.Printf("Closing the collections: %v", err)
+			}
+		}()
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query", s.handle(http.MethodPost, s.query, writeError))
+	mux.HandleFunc("/ask", s.handle(http.MethodPost, s.ask, writeError))
+	mux.HandleFunc("/ask/stream", s.handle(http.MethodPost, s.askStream, writeError))
+	s.handleOpenAI(mux)
+	if s.collections != nil {
+		s.handleCollections(mux)
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, "ok") })
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if (s.rag.Load() == nil && !s.noRAG) || s.stopping.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	server := &http.Server{Addr: params.addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	// Listen before loading the DB so orchestrators can probe /healthz & /readyz while it loads
+	listener, err := net.Listen("tcp", params.addr)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", params.addr, err)
+	}
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.Serve(listener) }()
+	if s.noRAG {
+		log.Printf("Listening on %s", params.addr)
+	} else {
+		log.Printf("Listening on %s; loading %s", params.addr, params.dbPathname)
+		rp, err := newRAGPipeline(&params.ragParams)
+		if err != nil {
+			server.Close()
+			return err
+		}
+		s.rag.Store(rp)
+		log.Printf("Ready")
+	}
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+	log.Printf("Shutting down; waiting up to %v for in-flight requests", params.shutdownTimeout)
+	s.stopping.Store(true)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), params.shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown: %v", err)
+		server.Close()
+	}
+	return nil
+}
+
+// handle returns a handler that only accepts method & calls h once the DB is loaded; errors are
+// written by writeErr.
+func (s *ragServer) handle(method string, h func(w http.ResponseWriter, r *http.Request, rp *ragPipeline) error,
+	writeErr func(w http.ResponseWriter, err error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rp := s.rag.Load()
+		var err error
+		switch {
+		case r.Method != method:
+			w.Header().Set("Allow", method)
+			err = httpError{http.StatusMethodNotAllowed, fmt.Errorf("use %s", method)}
+		case rp == nil && s.noRAG:
+			err = httpError{http.StatusNotFound, errors.New("no vector DB is being served; start serve with -db")}
+		case rp == nil:
+			err = httpError{http.StatusServiceUnavailable, errors.New("the vector DB is still loading")}
+		default:
+			r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+			err = h(w, r, rp)
+		}
+		if err != nil {
+			writeErr(w, err)
+		}
+		log.Printf("%s %s %v %v", r.Method, r.URL.Path, time.Since(start).Round(time.Millisecond), errorOrOK(err))
+	}
+}
+
+// handleWithoutRAG is like handle for an endpoint that doesn't need the ragPipeline.
+func (s *ragServer) handleWithoutRAG(method string, h func(w http.ResponseWriter, r *http.Request) error,
+	writeErr func(w http.ResponseWriter, err error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var err error
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			err = httpError{http.StatusMethodNotAllowed, fmt.Errorf("use %s", method)}
+		} else {
+			r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+			err = h(w, r)
+		}
+		if err != nil {
+			writeErr(w, err)
+		}
+		log.Printf("%s %s %v %v", r.Method, r.URL.Path, time.Since(start).Round(time.Millisecond), errorOrOK(err))
+	}
+}
+
+// httpError is an error with the HTTP status code reporting it.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e httpError) Error() string { return e.err.Error() }
+func (e httpError) Unwrap() error { return e.err }
+
+func badRequest(format string, a ...any) error {
+	return httpError{http.StatusBadRequest, fmt.Errorf(format, a...)}
+}
+
+// httpStatus returns the status code reporting err.
+func httpStatus(err error) int {
+	he := httpError{}
+	switch {
+	case errors.As(err, &he):
+		return he.status
+	case errors.Is(err, errCollectionNotFound), errors.Is(err, errEntryNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errCollectionExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrAuth), errors.Is(err, ErrServiceUnavailable): // The server's upstream service failed
+		return http.StatusBadGateway
+	case errors.Is(err, ErrContextLengthExceeded), errors.Is(err, ErrContentFiltered):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError writes err as a JSON object with a status code reflecting the error.
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, httpStatus(err), struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) // The client may have gone; nothing can be done about a failed write
+}
+
+func errorOrOK(err error) any {
+	if err == nil {
+		return "ok"
+	}
+	return err
+}
+
+// retrievalRequest holds the retrieval settings common to /query & /ask.
+type retrievalRequest struct {
+	K      int               `json:"k"`      // 0 uses -k
+	Filter map[string]string `json:"filter"` // Keys are the /filter chat command's: source, pages & text
+}
+
+// checkK returns a bad request error if the request asks for more than maxK results; every
+// result costs memory & an unauthenticated client mustn't be able to exhaust it.
+func (rr retrievalRequest) checkK(maxK int) error {
+	if rr.K > maxK {
+		return badRequest("k is %d but at most %d results may be requested", rr.K, maxK)
+	}
+	return nil
+}
+
+func (rr retrievalRequest) filter() (chatFilter, error) {
+	if len(rr.Filter) == 0 {
+		return chatFilter{}, nil
+	}
+	keys := maps.Keys(rr.Filter)
+	slices.Sort(keys) // Deterministic error messages
+	terms := []string{}
+	for _, k := range keys {
+		terms = append(terms, k+"="+rr.Filter[k])
+	}
+	f, err := newChatFilter(terms)
+	if err != nil {
+		return chatFilter{}, badRequest("%v", err)
+	}
+	return f, nil
+}
+
+func decodeRequest(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return badRequest("invalid request body: %v", err)
+	}
+	return nil
+}
+
+func (s *ragServer) query(w http.ResponseWriter, r *http.Request, rp *ragPipeline) error {
+	req := struct {
+		Query string `json:"query"`
+		retrievalRequest
+	}{}
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	if req.Query == "" {
+		return badRequest("query is required")
+	}
+	if err := req.checkK(s.maxK); err != nil {
+		return err
+	}
+	filter, err := req.filter()
+	if err != nil {
+		return err
+	}
+	if req.K <= 0 {
+		req.K = rp.params.maxGroundings
+	}
+	groundings, err := rp.Search(r.Context(), req.Query, req.K, filter)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Results []sessionGrounding `json:"results"`
+	}{newSessionGroundings(groundings)})
+	return nil
+}
+
+// askRequest is the body of /ask & /ask/stream.
+type askRequest struct {
+	Question string `json:"question"`
+	retrievalRequest
+	History []struct {
+		Role    string `json:"role"` // "user" or "assistant"
+		Content string `json:"content"`
+	} `json:"history"` // Earlier turns of the conversation, oldest first
+}
+
+func (req askRequest) ragRequest(rp *ragPipeline, maxK int) (ragRequest, error) {
+	if req.Question == "" {
+		return ragRequest{}, badRequest("question is required")
+	}
+	if err := req.checkK(maxK); err != nil {
+		return ragRequest{}, err
+	}
+	filter, err := req.filter()
+	if err != nil {
+		return ragRequest{}, err
+	}
+	cm, err := rp.NewConversation()
+	if err != nil {
+		return ragRequest{}, err
+	}
+	for _, t := range req.History {
+		switch t.Role {
+		case "user":
+			cm.AddUserContent(t.Content)
+		case "assistant":
+			cm.AddAssistantContent(t.Content)
+		default:
+			return ragRequest{}, badRequest("history role %q isn't user or assistant", t.Role)
+		}
+	}
+	return ragRequest{Question: req.Question, Conversation: cm, SessionID: "serve", K: req.K, Filter: filter}, nil
+}
+
+func (s *ragServer) ask(w http.ResponseWriter, r *http.Request, rp *ragPipeline) error {
+	req := askRequest{}
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	rr, err := req.ragRequest(rp, s.maxK)
+	if err != nil {
+		return err
+	}
+	ans, err := rp.Answer(r.Context(), rr)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, newAskResult(req.Question, ans, nil))
+	return nil
+}
+
+func (s *ragServer) askStream(w http.ResponseWriter, r *http.Request, rp *ragPipeline) error {
+	req := askRequest{}
+	if err := decodeRequest(r, &req); err != nil {
+		return err
+	}
+	rr, err := req.ragRequest(rp, s.maxK)
+	if err != nil {
+		return err
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("streaming isn't supported by this connection")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	send := func(event string, data any) {
+		b, err := json.Marshal(data)
+		if err != nil { // The status has been sent so the event can only be skipped
+			log.Printf("Encoding the %s event: %v", event, err)
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+		flusher.Flush()
+	}
+	rr.Searching = func(searchQuery string, expansions []string) {
+		send("search", struct {
+			SearchQuery string   `json:"searchQuery"`
+			Expansions  []string `json:"expansions,omitempty"`
+		}{searchQuery, expansions})
+	}
+	rr.Content = func(content string) {
+		send("delta", struct {
+			Content string `json:"content"`
+		}{content})
+	}
+	ans, err := rp.Answer(r.Context(), rr)
+	if err != nil { // The status has been sent so report the error as an event
+		send("error", struct {
+			Error string `json:"error"`
+		}{err.Error()})
+		return nil
+	}
+	send("done", newAskResult(req.Question, ans, nil))
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"JeffreyRichter.com/VectorDB/rag"
+)
+
+// chatSession is a chat's persisted state; sessions are saved after every answer so they can
+// be resumed with "chat -session <id>" & exported for attaching to tickets.
+type chatSession struct {
+	ID        string        `json:"id"`
+	DB        string        `json:"db"`
+	Created   time.Time     `json:"created"`
+	Updated   time.Time     `json:"updated"`
+	Summary   string        `json:"summary,omitempty"`   // Summary of turns forgotten by summarizingMemory
+	Retrieval string        `json:"retrieval,omitempty"` // The -retrieval mode, kept when the session is resumed
+	Turns     []sessionTurn `json:"turns"`
+	LiveTurn  int           `json:"liveTurn,omitempty"` // Index of the first turn still in the conversation; earlier turns were summarized or forgotten
+}
+
+type sessionTurn struct {
+	Time         time.Time          `json:"time"`
+	Question     string             `json:"question"`
+	SearchQuery  string             `json:"searchQuery,omitempty"` // Set if the question was rewritten for retrieval
+	Answer       string             `json:"answer"`
+	Truncated    bool               `json:"truncated,omitempty"` // The answer was cut short by Ctrl-C or a timeout
+	Groundings   []sessionGrounding `json:"groundings"`          // Numbered from 1 in the order given to the model
+	Cited        []int              `json:"cited,omitempty"`
+	Verification *verification      `json:"verification,omitempty"` // Set if -verify was used
+}
+
+type sessionGrounding struct {
+	Score     float32 `json:"score"`
+	Source    string  `json:"source,omitempty"`
+	FirstPage int     `json:"firstPage,omitempty"`
+	LastPage  int     `json:"lastPage,omitempty"`
+	Text      string  `json:"text"`
+}
+
+func newSessionGroundings(groundings []groundingData) []sessionGrounding {
+	sgs := make([]sessionGrounding, len(groundings))
+	for i, g := range groundings {
+		sgs[i] = sessionGrounding{Score: g.Score, Source: g.Source, FirstPage: g.FirstPage, LastPage: g.LastPage, Text: g.Text}
+	}
+	return sgs
+}
+
+func defaultSessionDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "VectorDB", "sessions")
+}
+
+// addSessionDirFlag adds the flag that specifies where sessions are saved to cmd.
+func addSessionDirFlag(cmd *flag.FlagSet, dir *string) {
+	cmd.StringVar(dir, "sessiondir", defaultSessionDir(), "directory where chat sessions are saved; empty disables saving")
+}
+
+func newSessionID() (string, error) {
+	b := [3]byte{}
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("generating a session ID: %w", err)
+	}
+	return time.Now().Format("20060102-150405-") + hex.EncodeToString(b[:]), nil
+}
+
+func sessionPathname(dir, id string) string { return filepath.Join(dir, id+".json") }
+
+func newChatSession(db string) (*chatSession, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &chatSession{ID: id, DB: db, Created: now, Updated: now}, nil
+}
+
+// loadChatSession returns the session with id; ok is false if there is no such session.
+func loadChatSession(dir, id string) (s *chatSession, ok bool, err error) {
+	pathname := sessionPathname(dir, id)
+	data, err := os.ReadFile(pathname)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	s = &chatSession{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, false, fmt.Errorf("session %s: %w", pathname, err)
+	}
+	return s, true, nil
+}
+
+// Save writes the session to dir using a temporary file so a crash never corrupts the session.
+func (s *chatSession) Save(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	s.Updated = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	pathname := sessionPathname(dir, s.ID)
+	if err := os.WriteFile(pathname+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(pathname+".tmp", pathname)
+}
+
+// Restore adds the session's summary & the turns it doesn't cover to cm so a resumed conversation
+// continues where it left off.
+func (s *chatSession) Restore(cm *rag.Conversation) {
+	if s.Summary != "" {
+		cm.SetSummary(s.Summary)
+	}
+	live := s.Turns
+	if s.LiveTurn <= len(s.Turns) {
+		live = s.Turns[s.LiveTurn:]
+	}
+	for _, t := range live {
+		cm.AddUserContent(t.Question)
+		if t.Truncated {
+			cm.AddAssistantContent(t.Answer + truncatedMarker)
+		} else {
+			cm.AddAssistantContent(t.Answer)
+		}
+	}
+}
+
+func (s *chatSession) ExportMarkdown(w io.Writer) {
+	fmt.Fprintf(w, "# Chat session %s\n\n", s.ID)
+	fmt.Fprintf(w, "- **Vector DB:** %s\n", s.DB)
+	fmt.Fprintf(w, "- **Started:** %s\n", s.Created.Format(time.RFC1123))
+	fmt.Fprintf(w, "- **Last updated:** %s\n", s.Updated.Format(time.RFC1123))
+	for i, t := range s.Turns {
+		fmt.Fprintf(w, "\n## Q%d: %s\n\n", i+1, t.Question)
+		if t.SearchQuery != "" && t.SearchQuery != t.Question {
+			fmt.Fprintf(w, "_Searched for: %s_\n\n", t.SearchQuery)
+		}
+		fmt.Fprintf(w, "%s\n", t.Answer)
+		if t.Truncated {
+			fmt.Fprintf(w, "\n_(Answer truncated)_\n")
+		}
+		if v := t.Verification; v != nil && v.Error != "" {
+			fmt.Fprintf(w, "\n**Groundedness:** not verified (%s)\n", v.Error)
+		} else if v != nil {
+			fmt.Fprintf(w, "\n**Groundedness:** %.0f%%\n", v.Groundedness*100)
+			for _, c := range v.Claims {
+				if !c.Supported {
+					fmt.Fprintf(w, "- _Unsupported:_ %s\n", c.Claim)
+				}
+			}
+		}
+		if len(t.Groundings) > 0 {
+			fmt.Fprintf(w, "\n**Sources:**\n\n")
+			for n, g := range t.Groundings {
+				cited := ""
+				if slices.Contains(t.Cited, n+1) {
+					cited = " _(cited)_"
+				}
+				fmt.Fprintf(w, "%d. %s, score %.3f%s: %s\n", n+1, sourceLabel(g.Source, g.FirstPage, g.LastPage), g.Score, cited, excerpt(g.Text, 160))
+			}
+		}
+	}
+}
+
+// excerpt returns the first max runes of text on a single line, adding an ellipsis if text was truncated.
+func excerpt(text string, max int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > max {
+		return string(runes[:max]) + "…"
+	}
+	return text
+}
+
+func sessions(arguments []string) error {
+	if len(arguments) < 1 {
+		return usageError("expected 'list' or 'export' sessions subcommands")
+	}
+	cmd := flag.NewFlagSet("sessions "+arguments[0], flag.ExitOnError)
+	dir, format := "", ""
+	addSessionDirFlag(cmd, &dir)
+	if arguments[0] == "export" {
+		cmd.StringVar(&format, "format", "md", "export format: md or json")
+	}
+	if err := parseCmdLine(cmd, arguments[1:]); err != nil {
+		return err
+	}
+
+	switch arguments[0] { // Check which sessions subcommand is invoked.
+	case "list":
+		entries, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		list := []*chatSession{}
+		for _, e := range entries {
+			if id, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+				if s, ok, err := loadChatSession(dir, id); err != nil {
+					fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", id, err) // List the sessions that can be read
+				} else if ok {
+					list = append(list, s)
+				}
+			}
+		}
+		slices.SortFunc(list, func(a, b *chatSession) bool { return a.Updated.After(b.Updated) }) // Most recent first
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUPDATED\tTURNS\tDB\tFIRST QUESTION")
+		for _, s := range list {
+			first := ""
+			if len(s.Turns) > 0 {
+				first = excerpt(s.Turns[0].Question, 50)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", s.ID, s.Updated.Format("2006-01-02 15:04"), len(s.Turns), s.DB, first)
+		}
+		return w.Flush()
+
+	case "export":
+		id := ""
+		if args := cmd.Args(); len(args) > 0 {
+			id = args[0]
+			cmd.Parse(args[1:]) // Also accept flags after the ID
+		}
+		if id == "" || cmd.NArg() != 0 {
+			return usageError("sessions export [-format=md|json] <id>")
+		}
+		s, ok, err := loadChatSession(dir, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("session %q not found in %q: %w", id, dir, fs.ErrNotExist)
+		}
+		switch format {
+		case "md":
+			s.ExportMarkdown(os.Stdout)
+			return nil
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(s)
+		default:
+			return usageError("unknown export format %q; expected md or json", format)
+		}
+
+	default:
+		return usageError("expected 'list' or 'export' sessions subcommands")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"JeffreyRichter.com/VectorDB/ingest"
+	"JeffreyRichter.com/VectorDB/rag"
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+// chatCommand is a command typed at the chat prompt instead of a question, for example "/k 8".
+type chatCommand struct {
+	name  string
+	args  string // Usage of the arguments
+	help  string
+	run   func(r *chatREPL, args []string) error
+	quits bool
+}
+
+// chatCommands is initialized in init because /help refers to it.
+var chatCommands []chatCommand
+
+func init() {
+	chatCommands = []chatCommand{
+		{name: "help", help: "list the commands", run: func(r *chatREPL, args []string) error {
+			for _, c := range chatCommands {
+				fmt.Printf("  %-22s %s\n", strings.TrimSpace("/"+c.name+" "+c.args), c.help)
+			}
+			return nil
+		}},
+		{name: "sources", help: "show the groundings given to the model for the last answer", run: (*chatREPL).sourcesCommand},
+		{name: "k", args: "[n]", help: "show or set the number of groundings retrieved for each question", run: func(r *chatREPL, args []string) error {
+			return intCommand(args, &r.params.maxGroundings, "k")
+		}},
+		{name: "filter", args: "[term...]", help: "only retrieve chunks matching every term: source=<file>, pages=<n>[-<m>], text=<word>; no terms clears the filter", run: func(r *chatREPL, args []string) error {
+			if len(args) > 0 {
+				f, err := newChatFilter(args)
+				if err != nil {
+					return err
+				}
+				r.filter = f
+			} else {
+				r.filter = chatFilter{}
+			}
+			fmt.Printf("filter: %s\n", r.filter)
+			return nil
+		}},
+		{name: "reset", help: "forget the conversation & start a new session", run: func(r *chatREPL, args []string) error {
+			session, err := newChatSession(r.params.dbPathname)
+			if err != nil {
+				return err
+			}
+			r.cm.ResetConversation()
+			r.session = session
+			r.session.Retrieval = r.params.retrieval.mode
+			r.last = rag.PromptBreakdown{}
+			fmt.Printf("Session %s\n", r.session.ID)
+			return nil
+		}},
+		{name: "history", help: "list the session's questions & answers", run: func(r *chatREPL, args []string) error {
+			for i, t := range r.session.Turns {
+				fmt.Printf("Q%d: %s\nA%d: %s\n", i+1, t.Question, i+1, excerpt(t.Answer, 200))
+			}
+			if s := r.cm.Summary(); s != "" {
+				fmt.Printf("Summary of earlier conversation: %s\n", excerpt(s, 500))
+			}
+			return nil
+		}},
+		{name: "save", args: "[pathname]", help: "save the session now or export it to a .md or .json file", run: (*chatREPL).saveCommand},
+		{name: "model", args: "[name]", help: "show or switch the chat model", run: func(r *chatREPL, args []string) error {
+			if len(args) > 0 {
+				if err := r.setChatModel(args[0]); err != nil {
+					return err
+				}
+			}
+			fmt.Printf("model: %s\n", r.rag.chatModel.Model())
+			return nil
+		}},
+		{name: "temp", args: "[t]", help: "show or set the sampling temperature", run: func(r *chatREPL, args []string) error {
+			if len(args) > 0 {
+				t, err := strconv.ParseFloat(args[0], 64)
+				if err != nil || t < 0 || t > 2 {
+					return fmt.Errorf("the temperature must be a number from 0 to 2")
+				}
+				r.params.temperature = t
+			}
+			fmt.Printf("temperature: %g\n", r.params.temperature)
+			return nil
+		}},
+		{name: "tokens", help: "show how the last prompt spent the context window", run: func(r *chatREPL, args []string) error {
+			if r.last.ContextWindow == 0 {
+				return fmt.Errorf("no prompt has been sent yet")
+			}
+			fmt.Println(r.last)
+			return nil
+		}},
+		{name: "quit", help: "end the chat", quits: true, run: func(r *chatREPL, args []string) error { return nil }},
+	}
+}
+
+// command runs the slash command in line & reports whether the chat should end.
+func (r *chatREPL) command(line string) (quit bool) {
+	fields := strings.Fields(strings.TrimPrefix(line, "/"))
+	if len(fields) == 0 {
+		fields = []string{"help"}
+	}
+	for _, c := range chatCommands {
+		if c.name == strings.ToLower(fields[0]) {
+			if err := c.run(r, fields[1:]); err != nil {
+				fmt.Printf("/%s: %v\n", c.name, err)
+			}
+			return c.quits
+		}
+	}
+	fmt.Printf("Unknown command %q; type /help for the commands\n", "/"+fields[0])
+	return false
+}
+
+// intCommand shows or, if args has a value, sets the positive int *v.
+func intCommand(args []string, v *int, name string) error {
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return fmt.Errorf("%q is not a positive number", args[0])
+		}
+		*v = n
+	}
+	fmt.Printf("%s: %d\n", name, *v)
+	return nil
+}
+
+func (r *chatREPL) sourcesCommand(args []string) error {
+	if len(r.session.Turns) == 0 {
+		return fmt.Errorf("no question has been answered yet")
+	}
+	t := r.session.Turns[len(r.session.Turns)-1]
+	if len(t.Groundings) == 0 {
+		fmt.Println("The last answer had no groundings")
+	}
+	for n, g := range t.Groundings {
+		fmt.Printf("[%d] %s, score %.3f\n    %s\n", n+1, sourceLabel(g.Source, g.FirstPage, g.LastPage), g.Score, excerpt(g.Text, 300))
+	}
+	return nil
+}
+
+func (r *chatREPL) saveCommand(args []string) error {
+	if len(args) == 0 {
+		if r.params.sessionDir == "" {
+			return fmt.Errorf("sessions aren't saved as -sessiondir is empty; specify a pathname to export to")
+		}
+		if err := r.session.Save(r.params.sessionDir); err != nil {
+			return err
+		}
+		fmt.Printf("Saved session %s to %s\n", r.session.ID, sessionPathname(r.params.sessionDir, r.session.ID))
+		return nil
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(args[0]), ".json") {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(r.session)
+	} else {
+		r.session.ExportMarkdown(f)
+	}
+	if err == nil {
+		fmt.Printf("Exported session %s to %s\n", r.session.ID, args[0])
+	}
+	return err
+}
+
+// chatFilter restricts the chunks retrieved by chat; the zero value retrieves every chunk.
+type chatFilter struct {
+	terms     []string
+	predicate func(e *vectordb.Entry) bool
+}
+
+func (f chatFilter) String() string {
+	if f.predicate == nil {
+		return "none"
+	}
+	return strings.Join(f.terms, " ")
+}
+
+// newChatFilter returns a filter matching the chunks that match every term.
+func newChatFilter(terms []string) (chatFilter, error) {
+	preds := []func(e *vectordb.Entry) bool{}
+	for _, term := range terms {
+		key, value, ok := strings.Cut(term, "=")
+		if !ok || value == "" {
+			return chatFilter{}, fmt.Errorf("%q isn't of the form key=value", term)
+		}
+		switch strings.ToLower(key) {
+		case "source":
+			preds = append(preds, func(e *vectordb.Entry) bool {
+				md, ok := e.Metadata.(*ingest.ChunkMetadata)
+				return ok && strings.EqualFold(md.Source, value)
+			})
+		case "pages", "page":
+			first, last, err := parsePageRange(value)
+			if err != nil {
+				return chatFilter{}, err
+			}
+			preds = append(preds, func(e *vectordb.Entry) bool { // The chunk overlaps the page range
+				md, ok := e.Metadata.(*ingest.ChunkMetadata)
+				return ok && md.FirstPage <= last && md.LastPage >= first
+			})
+		case "text":
+			value = strings.ToLower(value)
+			preds = append(preds, func(e *vectordb.Entry) bool { return strings.Contains(strings.ToLower(string(e.ID)), value) })
+		default:
+			return chatFilter{}, fmt.Errorf("unknown filter %q; expected source, pages or text", key)
+		}
+	}
+	return chatFilter{terms: terms, predicate: func(e *vectordb.Entry) bool {
+		for _, p := range preds {
+			if !p(e) {
+				return false
+			}
+		}
+		return true
+	}}, nil
+}
+
+// parsePageRange parses "n" or "n-m".
+func parsePageRange(s string) (first, last int, err error) {
+	firstText, lastText, isRange := strings.Cut(s, "-")
+	if !isRange {
+		lastText = firstText
+	}
+	first, err1 := strconv.Atoi(firstText)
+	last, err2 := strconv.Atoi(lastText)
+	if err1 != nil || err2 != nil || first < 1 || last < first {
+		return 0, 0, fmt.Errorf("%q isn't a page number or range like 3-10", s)
+	}
+	return first, last, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"JeffreyRichter.com/VectorDB/rag"
+)
+
+// promptData is what every chat prompt template can use. Templates are executed with the fields
+// relevant to them set; for example, systemMsg is executed once at startup with only Topic & Date.
+type promptData struct {
+	Topic      string
+	Date       string // Today's date, for example "October 19, 2026"
+	Question   string
+	Groundings []groundingData // Use {{.Number}}, {{.Score}}, {{.Source}}, {{.FirstPage}}, {{.LastPage}}, {{.Label}} & {{.Text}}
+	History    []rag.Turn      // The conversation so far; use {{.Role}} & {{.Content}}
+}
+
+func newPromptData(topic string) promptData {
+	return promptData{Topic: topic, Date: time.Now().Format("January 2, 2006")}
+}
+
+type templateParams struct {
+	system   string
+	user     string
+	condense string
+}
+
+// addTemplateFlags adds the flags that replace the built-in prompt templates to cmd.
+func addTemplateFlags(cmd *flag.FlagSet, p *templateParams) {
+	const usage = " prompt template (Go text/template using the fields of promptData); @pathname reads it from a file; empty uses the built-in template"
+	cmd.StringVar(&p.system, "systemprompt", "", "system"+usage)
+	cmd.StringVar(&p.user, "userprompt", "", "user message"+usage)
+	cmd.StringVar(&p.condense, "condenseprompt", "", "follow-up question condensing"+usage)
+}
+
+type promptTemplates struct {
+	system, user, condense, notCovered *template.Template
+}
+
+// loadPromptTemplates parses the chat prompt templates & executes each with sample data so
+// mistakes like misspelled fields are reported at startup instead of part way through a chat.
+func loadPromptTemplates(p templateParams, notCoveredMsg string) (*promptTemplates, error) {
+	t := &promptTemplates{}
+	for _, l := range []struct {
+		tmpl                 **template.Template
+		name, value, builtIn string
+	}{
+		{&t.system, "systemprompt", p.system, systemMsg},
+		{&t.user, "userprompt", p.user, userMsg},
+		{&t.condense, "condenseprompt", p.condense, condenseMsg},
+		{&t.notCovered, "notcoveredmsg", notCoveredMsg, ""},
+	} {
+		tmpl, err := loadPromptTemplate(l.name, l.value, l.builtIn)
+		if err != nil {
+			return nil, err
+		}
+		*l.tmpl = tmpl
+	}
+	return t, nil
+}
+
+// loadPromptTemplate returns the template named name from value, which is either the template
+// text or "@" followed by the pathname of a file containing it; builtIn is used if value is "".
+// It returns an error wrapping errUsage if the template can't be read or is invalid.
+func loadPromptTemplate(name, value, builtIn string) (*template.Template, error) {
+	text, source := value, "-"+name
+	switch {
+	case value == "":
+		text, source = builtIn, "the built-in template"
+	case strings.HasPrefix(value, "@"):
+		source = value[1:]
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return nil, fmt.Errorf("%w: can't read the %s template: %w", errUsage, name, err)
+		}
+		text = string(data)
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err == nil {
+		sample := newPromptData("Sample Topic")
+		sample.Question = "Sample question?"
+		sample.Groundings = []groundingData{{Number: 1, Score: 0.9, Source: "sample.pdf", FirstPage: 1, LastPage: 2, Text: "Sample grounding."}}
+		sample.History = []rag.Turn{{Role: "user", Content: "Sample question?"}, {Role: "assistant", Content: "Sample answer."}}
+		err = tmpl.Execute(&strings.Builder{}, sample)
+	}
+	if err != nil {
+		return nil, usageError("invalid %s template from %s: %v", name, source, err)
+	}
+	return tmpl, nil
+}
+
+// templateToString executes tmpl. If that fails, the caller must fail its request rather than send
+// the model a partial prompt, which would produce misleading answers. A template validated at
+// startup can still fail on real data, e.g. by indexing past the groundings that fit.
+func templateToString(tmpl *template.Template, data any) (string, error) {
+	sb := &strings.Builder{}
+	if err := tmpl.Execute(sb, data); err != nil {
+		return "", fmt.Errorf("executing the %s template: %w", tmpl.Name(), err)
+	}
+	return sb.String(), nil
+}
@@ -7,8 +7,11 @@ import (
 	"github.com/pkoukk/tiktoken-go"
 )
 
-func tokensPlay() {
-	encoding := must(tiktoken.GetEncoding("r50k_base"))
+func tokensPlay() error {
+	encoding, err := tiktoken.GetEncoding("r50k_base")
+	if err != nil {
+		return err
+	}
 	tokens := encoding.Encode("Now is the time for all good men to come to the aid of their party.", nil, nil)
 	fmt.Printf("Encode: %v\n", tokens)
 	fmt.Printf("Decode: %s\n\n", encoding.Decode(tokens))
@@ -18,6 +21,7 @@ func tokensPlay() {
 	for i, allTokens := 0, getAllTokens(encoding); i < len(allTokens); i++ {
 		fmt.Printf("%d: %q\n", i, allTokens[i])
 	}
+	return nil
 }
 
 func getAllTokens(encoding *tiktoken.Tiktoken) []string {
@@ -0,0 +1,66 @@
+package vectordb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestQueryMergesHalvesWithoutMatches(t *testing.T) {
+	entries := make([]*Entry, 300) // More than querySlice's threshold so the entries are split into halves
+	for i := range entries {
+		entries[i] = &Entry{ID: ID(fmt.Sprintf("%03d", i)), Vector: []float32{1, float32(i) / 300}}
+	}
+	db := New(CosineSimilarity{}, entries)
+	for _, tc := range []struct {
+		name      string
+		predicate func(e *Entry) bool
+	}{
+		{"matches only in the first half", func(e *Entry) bool { return e.ID < "010" }},
+		{"matches only in the last half", func(e *Entry) bool { return e.ID >= "290" }},
+		{"matches in both halves", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			results, err := db.Query([]float32{1, 0}, 5, tc.predicate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 5 {
+				t.Fatalf("Query returned %d results; want 5", len(results))
+			}
+		})
+	}
+}
+
+func TestQueryClampsTopKAcrossHalves(t *testing.T) {
+	entries := make([]*Entry, 300) // A panic allocating topK results in a spawned goroutine would crash the process
+	for i := range entries {
+		entries[i] = &Entry{ID: ID(fmt.Sprintf("%03d", i)), Vector: []float32{1, float32(i) / 300}}
+	}
+	results, err := New(CosineSimilarity{}, entries).Query([]float32{1, 0}, 1<<50, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(entries) {
+		t.Fatalf("Query returned %d results; want all %d", len(results), len(entries))
+	}
+}
+
+func TestQueryMergesHalvesClosestFirst(t *testing.T) {
+	entries := make([]*Entry, 300)
+	for i := range entries {
+		entries[i] = &Entry{ID: ID(fmt.Sprintf("%03d", i)), Vector: []float32{1, float32(i) / 300}}
+	}
+	for _, metric := range []DistanceMetric{CosineSimilarity{}, DotProduct{}} {
+		t.Run(fmt.Sprintf("%T", metric), func(t *testing.T) {
+			results, err := New(metric, entries).Query([]float32{0, 1}, 3, nil) // Both scores grow with the entry's index
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range []ID{"299", "298", "297"} {
+				if results[i].Entry.ID != want {
+					t.Fatalf("result %d is %q; want %q", i, results[i].Entry.ID, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+// Package vectordb is an in-memory vector database: entries, each identified by an ID & holding a
+// vector & arbitrary metadata, are queried for the vectors nearest to a query vector.
+// A DB's entries can be saved to & loaded from a file with Save & Load.
+package vectordb
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+
+	"golang.org/x/exp/slices"
+)
+
+// Errors returned by the DB. They're wrapped with details so use errors.Is to check for them.
+var (
+	ErrDimensionMismatch = errors.New("vector dimensions don't match")
+	ErrDBCorrupt         = errors.New("the vector DB is corrupt")
+)
+
+// ID identifies an Entry; the entries created by the VectorDB command use the chunk's text.
+type ID string
+
+// Entry is a vector & its metadata. Metadata must be registered with gob.Register for the entry
+// to be saved.
+type Entry struct {
+	ID       ID
+	Metadata any
+	Vector   []float32
+}
+
+func (e *Entry) String() string {
+	vectorHigh := len(e.Vector)
+	if vectorHigh > 3 {
+		vectorHigh = 3
+	}
+	return fmt.Sprintf("ID=%s, Metadata=%#v, Vector=%v", e.ID, e.Metadata, e.Vector[:vectorHigh])
+}
+
+// DB is a vector database; all its entries' vectors have the same length. A DB may be queried &
+// modified concurrently.
+type DB struct {
+	mu             sync.RWMutex // Guards entries so a DB can be queried & modified concurrently
+	entries        []*Entry
+	distanceMetric DistanceMetric
+}
+
+// New creates a new vector DB with the specified distance metric and entries.
+// Note that the entries MUST be sorted by ID or all operations are unpredictable.
+func New(distanceMetric DistanceMetric, entries []*Entry) *DB {
+	return &DB{distanceMetric: distanceMetric, entries: entries}
+}
+
+func (db *DB) search(id ID) (int, bool) {
+	return slices.BinarySearchFunc(db.entries, id, func(e *Entry, searchID ID) int {
+		if e.ID < searchID {
+			return -1
+		}
+		if e.ID > searchID {
+			return 1
+		}
+		return 0
+	})
+}
+
+// dimensions returns the length of the entries' vectors; 0 if the DB is empty.
+func (db *DB) dimensions() int {
+	if len(db.entries) == 0 {
+		return 0
+	}
+	return len(db.entries[0].Vector)
+}
+
+// Dimensions returns the length of the entries' vectors; 0 if the DB is empty.
+func (db *DB) Dimensions() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.dimensions()
+}
+
+// Upsert adds entry to the DB, replacing any entry with the same ID. It returns an error wrapping
+// ErrDimensionMismatch if entry's vector is empty or isn't the same length as the other entries'
+// vectors; replacing the DB's only entry leaves no other entries so it may change the length.
+func (db *DB) Upsert(entry *Entry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n, ok := db.search(entry.ID)
+	if dims := db.dimensions(); len(entry.Vector) == 0 || (dims != 0 && len(entry.Vector) != dims && !(ok && len(db.entries) == 1)) {
+		return fmt.Errorf("%w: entry %q has a %d-dimension vector but the DB's vectors have %d", ErrDimensionMismatch, entry.ID, len(entry.Vector), dims)
+	}
+	if !ok {
+		db.entries = slices.Insert(db.entries, n, entry)
+	} else {
+		db.entries[n] = entry
+	}
+	return nil
+}
+
+// Get returns the entry identified by id; ok is false if there is no such entry.
+func (db *DB) Get(id ID) (*Entry, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	n, ok := db.search(id)
+	if !ok {
+		return nil, false
+	}
+	return db.entries[n], true
+}
+
+// Delete removes the entry identified by id if there is one.
+func (db *DB) Delete(id ID) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if n, ok := db.search(id); ok {
+		db.entries = slices.Delete(db.entries, n, n+1)
+	}
+}
+
+// SearchResult is an entry found by Query & its score for the query vector.
+type SearchResult struct {
+	Score float32
+	Entry *Entry
+}
+
+// Len returns the number of entries in the DB.
+func (db *DB) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.entries)
+}
+
+// Entries returns a copy of the DB's entries sorted by ID.
+func (db *DB) Entries() []*Entry {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return slices.Clone(db.entries)
+}
+
+// Query returns the topK entries closest to vector, closest first, skipping entries for which
+// predicate returns false; predicate may be nil. A topK larger than the DB returns every entry
+// that satisfies predicate. It returns an error wrapping ErrDimensionMismatch if vector isn't the
+// same length as the entries' vectors.
+func (db *DB) Query(vector []float32, topK int, predicate func(e *Entry) bool) ([]SearchResult, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if dims := db.dimensions(); dims != 0 && len(vector) != dims {
+		return nil, fmt.Errorf("%w: the query vector has %d dimensions but the DB's vectors have %d", ErrDimensionMismatch, len(vector), dims)
+	}
+	switch { // Each leaf allocates topK results so never allocate more than there are entries
+	case topK > len(db.entries):
+		topK = len(db.entries)
+	case topK < 0:
+		topK = 0
+	}
+	return db.querySlice(db.entries, vector, topK, predicate), nil
+}
+
+func (db *DB) querySlice(entries []*Entry, vector []float32, topK int, predicate func(e *Entry) bool) []SearchResult {
+	const threshold = 100         // Each goroutine processes at most 'threshold' entries
+	if len(entries) > threshold { // https://www.youtube.com/watch?v=P1tREHhINH4
+		half := len(entries) / 2
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		var leftResult []SearchResult
+		go func() {
+			defer wg.Done()
+			leftResult = db.querySlice(entries[:half], vector, topK, predicate) // 0 to (half-1) inclusive
+		}()
+		rightResult := db.querySlice(entries[half:], vector, topK, predicate) // half to (len-1) inclusive
+		wg.Wait()
+		// Return the top K scores from both left & right
+		results := make([]SearchResult, 0, topK) // Slice of length 0, capacity topK; sorted from best Score to worst score
+		for (len(results) < topK) /* want more */ && (len(leftResult) > 0 || len(rightResult) > 0) /* more available */ {
+			switch {
+			case len(leftResult) == 0: // Only right results left
+				results = append(results, rightResult[0])
+				rightResult = rightResult[1:]
+			case len(rightResult) == 0: // Only left results left
+				results = append(results, leftResult[0])
+				leftResult = leftResult[1:]
+			case db.closer(leftResult[0].Score, rightResult[0].Score): // Left result is better than right
+				results = append(results, leftResult[0])
+				leftResult = leftResult[1:]
+			default: // Right result is same or better than left
+				results = append(results, rightResult[0])
+				rightResult = rightResult[1:]
+			}
+		}
+		return results
+	}
+
+	results := make([]SearchResult, 0, topK) // Slice of length 0, capacity topK; sorted from closest to farthest
+	for _, e := range entries {
+		if predicate != nil && !predicate(e) { // If predicate returns false, skip this entry
+			continue
+		}
+		sr := SearchResult{Score: db.distanceMetric.Distance(vector, e.Vector), Entry: e} // Calculate potential result
+		// If score is better than worst result, insert it
+		// Where would this score be inserted?
+		n, _ := slices.BinarySearchFunc(results, sr, func(a, b SearchResult) int {
+			switch {
+			case db.closer(a.Score, b.Score):
+				return -1
+			case db.closer(b.Score, a.Score):
+				return 1
+			}
+			return 0
+		})
+		if n == cap(results) {
+			// We're at capacity & Score is lower than anything we already have; do nothing
+		} else {
+			if len(results) == topK { // If there is no space, delete the worst (last) result
+				results = slices.Delete(results, len(results)-1, len(results)) // Otherwise, delete the worst result and insert it
+			}
+			results = slices.Insert(results, n, sr) // Insert the new result
+		}
+	}
+	return results
+}
+
+// closer returns true if score a means closer vectors than score b under the DB's metric.
+func (db *DB) closer(a, b float32) bool {
+	if db.distanceMetric.BiggerIsCloser() {
+		return a > b
+	}
+	return a < b
+}
+
+// DistanceMetric scores how close 2 vectors of the same length are.
+type DistanceMetric interface {
+	Distance(a, b []float32) float32
+
+	// BiggerIsCloser returns true if Distance is a similarity (a bigger score means closer vectors)
+	// & false if it's a true distance (a smaller score means closer vectors).
+	BiggerIsCloser() bool
+}
+
+var _, _ DistanceMetric = CosineSimilarity{}, DotProduct{}
+
+// Metrics maps the names of the distance metrics to the metrics.
+var Metrics = map[string]DistanceMetric{"cosine": CosineSimilarity{}, "dot": DotProduct{}}
+
+// CosineSimilarity scores vectors by the cosine of the angle between them.
+type CosineSimilarity struct{}
+
+func (c CosineSimilarity) Distance(a, b []float32) float32 {
+	// If the vector lengths do not match, this funtion panics
+	// Algorithms: https://www.pinecone.io/learn/vector-similarity/
+	// https://weaviate.io/blog/distance-metrics-in-vector-search
+	dotProduct, magnitudeA, magnitudeB := 0.0, 0.0, 0.0
+	for k := 0; k < len(a); k++ {
+		dotProduct += float64(a[k] * b[k])
+		magnitudeA += math.Pow(float64(a[k]), 2)
+		magnitudeB += math.Pow(float64(b[k]), 2)
+	}
+	return float32(dotProduct / (math.Sqrt(magnitudeA) * math.Sqrt(magnitudeB)))
+}
+
+func (c CosineSimilarity) BiggerIsCloser() bool { return true }
+
+// DotProduct scores vectors by their dot product; for normalized vectors it equals CosineSimilarity.
+type DotProduct struct{}
+
+func (d DotProduct) Distance(a, b []float32) float32 {
+	// If the vector lengths do not match, this funtion panics
+	// Algorithms: https://www.pinecone.io/learn/vector-similarity/
+	// https://weaviate.io/blog/distance-metrics-in-vector-search
+	dotProduct := float32(0.0)
+	for k := 0; k < len(a); k++ {
+		dotProduct += a[k] * b[k]
+	}
+	return dotProduct
+}
+
+func (d DotProduct) BiggerIsCloser() bool { return true }
+
+// Load returns a DB with the entries saved in the file at pathname by Save. It returns an error
+// wrapping ErrDBCorrupt if the file isn't a vector DB or its entries are inconsistent.
+func Load(pathname string, distanceMetric DistanceMetric) (*DB, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := []*Entry{}
+	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrDBCorrupt, pathname, err)
+	}
+	for i, e := range entries { // The entries MUST be sorted by ID & have vectors of the same length
+		switch {
+		case e == nil || len(e.Vector) == 0:
+			return nil, fmt.Errorf("%w: %s: entry %d has no vector", ErrDBCorrupt, pathname, i)
+		case len(e.Vector) != len(entries[0].Vector):
+			return nil, fmt.Errorf("%w: %s: entry %d has a %d-dimension vector but entry 0's has %d", ErrDBCorrupt, pathname, i, len(e.Vector), len(entries[0].Vector))
+		case i > 0 && entries[i-1].ID > e.ID:
+			return nil, fmt.Errorf("%w: %s: the entries aren't sorted by ID", ErrDBCorrupt, pathname)
+		}
+	}
+	return New(distanceMetric, entries), nil
+}
+
+// Save writes the DB's entries to the file at pathname. The entries are written to a temporary
+// file that is synced to disk & renamed so a crash leaves either the old or the new file.
+func (db *DB) Save(pathname string) error {
+	tmpPathname := pathname + ".tmp"
+	f, err := os.Create(tmpPathname)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(db.Entries()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPathname, pathname)
+}
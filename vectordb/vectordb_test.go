@@ -0,0 +1,148 @@
+package vectordb
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpsert(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []*Entry
+		upsert  *Entry
+		wantErr error
+		wantLen int
+	}{
+		{"into empty DB", nil, &Entry{ID: "a", Vector: []float32{1, 2, 3}}, nil, 1},
+		{"same dimension", []*Entry{{ID: "a", Vector: []float32{1, 2}}}, &Entry{ID: "b", Vector: []float32{3, 4}}, nil, 2},
+		{"replace", []*Entry{{ID: "a", Vector: []float32{1, 2}}, {ID: "b", Vector: []float32{3, 4}}}, &Entry{ID: "a", Vector: []float32{5, 6}}, nil, 2},
+		{"different dimension", []*Entry{{ID: "a", Vector: []float32{1, 2}}}, &Entry{ID: "b", Vector: []float32{1, 2, 3}}, ErrDimensionMismatch, 1},
+		{"empty vector", nil, &Entry{ID: "a"}, ErrDimensionMismatch, 0},
+		// Replacing the only entry leaves no vector of the old dimension so the DB takes the new one
+		{"replace only entry with different dimension", []*Entry{{ID: "a", Vector: []float32{1, 2}}}, &Entry{ID: "a", Vector: []float32{1, 2, 3}}, nil, 1},
+		{"replace one of two entries with different dimension", []*Entry{{ID: "a", Vector: []float32{1, 2}}, {ID: "b", Vector: []float32{3, 4}}},
+			&Entry{ID: "a", Vector: []float32{1, 2, 3}}, ErrDimensionMismatch, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := New(CosineSimilarity{}, tc.entries)
+			if err := db.Upsert(tc.upsert); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Upsert returned %v; want %v", err, tc.wantErr)
+			}
+			if db.Len() != tc.wantLen {
+				t.Fatalf("Len is %d; want %d", db.Len(), tc.wantLen)
+			}
+			if e, ok := db.Get(tc.upsert.ID); (tc.wantErr == nil) != (ok && e == tc.upsert) {
+				t.Fatalf("Get(%q) returned %v, %v after Upsert returned %v", tc.upsert.ID, e, ok, tc.wantErr)
+			}
+			entries := db.Entries()
+			for i := 1; i < len(entries); i++ {
+				if entries[i-1].ID >= entries[i].ID {
+					t.Fatalf("entries aren't sorted by ID: %v", entries)
+				}
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	entries := []*Entry{
+		{ID: "east", Metadata: "x", Vector: []float32{1, 0}},
+		{ID: "north", Metadata: "y", Vector: []float32{0, 1}},
+		{ID: "northeast", Metadata: "x", Vector: []float32{1, 1}},
+	}
+	for _, tc := range []struct {
+		name      string
+		metric    DistanceMetric
+		vector    []float32
+		topK      int
+		predicate func(e *Entry) bool
+		want      []ID
+		wantErr   error
+	}{
+		{"closest first", CosineSimilarity{}, []float32{1, 0.1}, 3, nil, []ID{"east", "northeast", "north"}, nil},
+		{"topK", CosineSimilarity{}, []float32{0.1, 1}, 2, nil, []ID{"north", "northeast"}, nil},
+		{"topK larger than the DB", CosineSimilarity{}, []float32{1, 0.1}, 1 << 50, nil, []ID{"east", "northeast", "north"}, nil},
+		{"negative topK", CosineSimilarity{}, []float32{1, 0.1}, -1, nil, []ID{}, nil},
+		{"predicate", CosineSimilarity{}, []float32{0.1, 1}, 3, func(e *Entry) bool { return e.Metadata == "x" }, []ID{"northeast", "east"}, nil},
+		{"dimension mismatch", CosineSimilarity{}, []float32{1, 0, 0}, 3, nil, nil, ErrDimensionMismatch},
+		// Unlike cosine similarity, the dot product grows with the vectors' magnitudes
+		{"dot product biggest first", DotProduct{}, []float32{1, 0.1}, 3, nil, []ID{"northeast", "east", "north"}, nil},
+		{"dot product negative scores", DotProduct{}, []float32{-1, -0.5}, 3, nil, []ID{"north", "east", "northeast"}, nil},
+		{"dot product topK", DotProduct{}, []float32{-1, -0.5}, 1, nil, []ID{"north"}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			results, err := New(tc.metric, entries).Query(tc.vector, tc.topK, tc.predicate)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Query returned %v; want %v", err, tc.wantErr)
+			}
+			if len(results) != len(tc.want) {
+				t.Fatalf("Query returned %d results; want %d", len(results), len(tc.want))
+			}
+			for i, r := range results {
+				if r.Entry.ID != tc.want[i] {
+					t.Errorf("result %d is %q; want %q", i, r.Entry.ID, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	pathname := filepath.Join(t.TempDir(), "db.gob")
+	entries := []*Entry{{ID: "a", Vector: []float32{1, 2}}, {ID: "b", Vector: []float32{3, 4}}}
+	if err := New(DotProduct{}, entries).Save(pathname); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Load(pathname, DotProduct{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Len() != 2 || db.Dimensions() != 2 {
+		t.Fatalf("loaded %d entries of %d dimensions; want 2 of 2", db.Len(), db.Dimensions())
+	}
+	if e, ok := db.Get("b"); !ok || e.Vector[1] != 4 {
+		t.Fatalf("Get(b) returned %v, %v", e, ok)
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []*Entry // Encoded with gob unless data is set
+		data    string
+		wantErr error
+	}{
+		{"not a vector DB", nil, "this isn't gob", ErrDBCorrupt},
+		{"no vector", []*Entry{{ID: "a", Vector: []float32{1}}, {ID: "b"}}, "", ErrDBCorrupt},
+		{"inconsistent dimensions", []*Entry{{ID: "a", Vector: []float32{1}}, {ID: "b", Vector: []float32{1, 2}}}, "", ErrDBCorrupt},
+		{"unsorted", []*Entry{{ID: "b", Vector: []float32{1}}, {ID: "a", Vector: []float32{2}}}, "", ErrDBCorrupt},
+		// Documents can repeat a chunk's text so createdb has always written duplicate IDs
+		{"duplicate IDs", []*Entry{{ID: "a", Vector: []float32{1}}, {ID: "a", Vector: []float32{2}}}, "", nil},
+		{"missing file", nil, "", os.ErrNotExist},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pathname := filepath.Join(t.TempDir(), "db.gob")
+			if tc.entries != nil || tc.data != "" {
+				f, err := os.Create(pathname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.data != "" {
+					_, err = f.WriteString(tc.data)
+				} else {
+					err = gob.NewEncoder(f).Encode(tc.entries)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+			}
+			if _, err := Load(pathname, CosineSimilarity{}); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Load returned %v; want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
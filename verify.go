@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/cognitiveservices/azopenai"
+
+	"JeffreyRichter.com/VectorDB/vectordb"
+)
+
+type verifyParams struct {
+	mode      string // "off", "embedding", "llm" or "both"
+	threshold float64
+}
+
+// addVerifyFlags adds the flags that configure answer verification to cmd.
+func addVerifyFlags(cmd *flag.FlagSet, p *verifyParams) {
+	cmd.StringVar(&p.mode, "verify", "off", "check each answer's claims against its groundings: off, embedding, llm (a judge prompt) or both")
+	cmd.Float64Var(&p.threshold, "verifythreshold", 0.8, "minimum cosine similarity between a claim & a grounding for the embedding check to consider the claim supported")
+}
+
+// answerVerifier checks that each claim in an answer is supported by the groundings the answer
+// was based on, as the [TASK] in systemMsg demands.
+type answerVerifier struct {
+	mode      string
+	threshold float32
+	embedder  Embedder
+	model     ChatModel
+}
+
+func newAnswerVerifier(p verifyParams, embedder Embedder, model ChatModel) (*answerVerifier, error) {
+	switch p.mode {
+	case "off":
+		return nil, nil
+	case "embedding", "llm", "both":
+		return &answerVerifier{mode: p.mode, threshold: float32(p.threshold), embedder: embedder, model: model}, nil
+	default:
+		return nil, usageError("unknown verification mode %q; expected off, embedding, llm or both", p.mode)
+	}
+}
+
+type claimVerdict struct {
+	Claim      string  `json:"claim"`
+	Similarity float32 `json:"similarity,omitempty"` // Best similarity to a grounding; embedding check only
+	Supported  bool    `json:"supported"`
+}
+
+type verification struct {
+	Claims       []claimVerdict `json:"claims"`
+	Groundedness float64        `json:"groundedness"`    // Fraction of claims supported
+	Error        string         `json:"error,omitempty"` // Why the answer couldn't be verified; Claims & Groundedness are then unset
+}
+
+var (
+	sentenceRegexp = regexp.MustCompile(`[^.!?\n]+(?:[.!?]+(?:\s*\[\d+(?:\s*,\s*\d+)*\])*|$)`) // A sentence & the citations following it
+	bulletRegexp   = regexp.MustCompile(`^\s*(?:[-*•]|\d+[.)])\s+`)
+)
+
+// splitClaims splits an answer into sentences, ignoring fragments too short to state a fact.
+func splitClaims(answer string) []string {
+	claims := []string{}
+	for _, line := range strings.Split(answer, "\n") {
+		for _, s := range sentenceRegexp.FindAllString(bulletRegexp.ReplaceAllString(line, ""), -1) {
+			if s = strings.TrimSpace(s); len(strings.Fields(s)) >= 4 {
+				claims = append(claims, s)
+			}
+		}
+	}
+	return claims
+}
+
+// Verify returns a verdict for each of answer's claims. A nil verifier verifies nothing.
+func (v *answerVerifier) Verify(ctx context.Context, answer string, groundings []groundingData, vectors [][]float32) (*verification, error) {
+	claims := splitClaims(answer)
+	if v == nil || len(claims) == 0 {
+		return nil, nil
+	}
+	result := &verification{Claims: make([]claimVerdict, len(claims))}
+	for i, c := range claims {
+		result.Claims[i] = claimVerdict{Claim: c, Supported: true}
+	}
+
+	if v.mode == "embedding" || v.mode == "both" {
+		// Citations carry no meaning in embedding space so remove them before embedding
+		texts := make([]string, len(claims))
+		for i, c := range claims {
+			texts[i] = citationRegexp.ReplaceAllString(c, "")
+		}
+		claimVectors, err := v.embedder.Embed(ctx, texts)
+		if err != nil {
+			return nil, err
+		}
+		for i, cv := range claimVectors {
+			best := float32(0)
+			for _, gv := range vectors {
+				if s := (vectordb.CosineSimilarity{}).Distance(cv, gv); s > best {
+					best = s
+				}
+			}
+			result.Claims[i].Similarity = best
+			result.Claims[i].Supported = best >= v.threshold
+		}
+	}
+
+	if v.mode == "llm" || v.mode == "both" {
+		supported, err := v.judge(ctx, claims, groundings)
+		if err != nil {
+			return nil, err
+		}
+		for i := range result.Claims {
+			result.Claims[i].Supported = result.Claims[i].Supported && supported[i]
+		}
+	}
+
+	n := 0
+	for _, c := range result.Claims {
+		if c.Supported {
+			n++
+		}
+	}
+	result.Groundedness = float64(n) / float64(len(result.Claims))
+	return result, nil
+}
+
+const judgeMsg = `
+You are a strict fact checker. For each numbered [CLAIM], decide whether it is fully supported by the [GROUNDING] text alone.
+A [CLAIM] that is a greeting, a question, or says the information is not available counts as supported.
+Respond with only a JSON array containing one boolean per [CLAIM], in order, for example [true,false,true].
+
+[GROUNDING]
+{{range .Groundings}}[{{.Number}}] {{.Text}}
+
+{{end}}
+[CLAIM]
+{{range .Claims}}{{.}}
+{{end}}`
+
+var judgeMsgTmpl = template.Must(template.New("judgeMsg").Parse(judgeMsg))
+
+// judge asks the chat model which claims the groundings support.
+func (v *answerVerifier) judge(ctx context.Context, claims []string, groundings []groundingData) ([]bool, error) {
+	numbered := make([]string, len(claims))
+	for i, c := range claims {
+		numbered[i] = fmt.Sprintf("%d. %s", i+1, c)
+	}
+	judgePrompt, err := templateToString(judgeMsgTmpl, struct {
+		Groundings []groundingData
+		Claims     []string
+	}{groundings, numbered})
+	if err != nil {
+		return nil, err
+	}
+	verdict, err := complete(ctx, v.model, []azopenai.ChatMessage{{Role: to.Ptr(azopenai.ChatRoleUser), Content: &judgePrompt}},
+		chatOptions{MaxTokens: int32(16 + 8*len(claims)), Temperature: 0.0})
+	if err != nil {
+		return nil, err
+	}
+	supported := []bool{}
+	verdict = jsonArray(verdict)
+	if err := json.Unmarshal([]byte(verdict), &supported); err != nil || len(supported) != len(claims) {
+		return nil, fmt.Errorf("the judge returned an unexpected verdict: %q", verdict)
+	}
+	return supported, nil
+}
+
+// printVerification writes the groundedness score & highlights the unsupported claims.
+func printVerification(w io.Writer, v *verification) {
+	if v == nil {
+		return
+	}
+	if v.Error != "" {
+		fmt.Fprintf(w, "\nWarning: the answer couldn't be verified: %s\n", v.Error)
+		return
+	}
+	supported := 0
+	for _, c := range v.Claims {
+		if c.Supported {
+			supported++
+		}
+	}
+	fmt.Fprintf(w, "\nGroundedness: %d of %d claims supported (%.0f%%)\n", supported, len(v.Claims), v.Groundedness*100)
+	for _, c := range v.Claims {
+		if !c.Supported {
+			fmt.Fprintf(w, "  %s%sUNSUPPORTED:%s %s\n", BackgroundYellow, ForewardBlack, ResetAllAttributes, c.Claim)
+		}
+	}
+}